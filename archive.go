@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"io"
+	"path"
+	"strings"
+)
+
+var errInvalidArchive = errors.New("некорректный формат zip архива")
+var errArchiveTooManyEntries = errors.New("архив содержит слишком много файлов")
+var errArchiveTooLarge = errors.New("размер распакованных файлов архива превышает допустимый")
+var errArchiveRatio = errors.New("степень сжатия файла в архиве превышает допустимую")
+
+// ограничения на содержимое zip архивов (защита от zip-бомб): количество элементов,
+// суммарный размер распакованных файлов и степень сжатия
+var maxArchiveEntries = 100
+var maxArchiveBytes int64 = 1 << 30
+var maxCompressionRatio int64 = 100
+
+// объем распакованных данных, до которого степень сжатия не проверяется
+const compressionRatioGrace = 1 << 20
+
+// Результат обработки одного файла из архива
+type TaskFile struct {
+	FileName     string       `json:"file_name"`
+	NumErrors    *int         `json:"num_errors"`
+	NumCreated   *int         `json:"num_created"`
+	NumUpdated   *int         `json:"num_updated"`
+	NumDeleted   *int         `json:"num_deleted"`
+	ErrorMessage *string      `json:"error_message"`
+	Sheets       *SheetReport `json:"sheets,omitempty"`
+}
+
+func (f *TaskFile) setCounters(counters loadCounters) {
+	f.NumErrors, f.NumCreated = &counters.Errors, &counters.Created
+	f.NumUpdated, f.NumDeleted = &counters.Updated, &counters.Deleted
+}
+
+// Чтение распакованного содержимого с контролем степени сжатия
+type ratioReader struct {
+	reader     io.Reader
+	compressed int64
+	read       int64
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > compressionRatioGrace && r.read > r.compressed*maxCompressionRatio {
+		return n, errArchiveRatio
+	}
+	return n, err
+}
+
+// Служебные файлы и каталоги архива, которые пропускаются без сообщения об ошибке
+func skippedArchiveEntry(entry *zip.File) bool {
+	return entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") ||
+		strings.HasPrefix(path.Base(entry.Name), ".")
+}
+
+// Распаковать файл архива во временный файл. budget -- оставшийся допустимый объем распакованных данных
+func extractArchiveFile(entry *zip.File, budget *int64) (*uploadedFile, error) {
+	if int64(entry.UncompressedSize64) > *budget {
+		return nil, errArchiveTooLarge
+	}
+	if entry.UncompressedSize64 > compressionRatioGrace &&
+		int64(entry.UncompressedSize64) > int64(entry.CompressedSize64)*maxCompressionRatio {
+		return nil, errArchiveRatio
+	}
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, errInvalidArchive
+	}
+	defer reader.Close()
+	file, err := saveUpload(&ratioReader{reader: reader, compressed: int64(entry.CompressedSize64)}, entry.Name, *budget)
+	switch err {
+	case nil:
+		*budget -= file.Size
+		return file, nil
+	case errFileTooLarge:
+		return nil, errArchiveTooLarge
+	case errArchiveRatio:
+		return nil, err
+	}
+	return nil, errInvalidArchive
+}
+
+// Загрузить товары из всех табличных файлов архива. Ошибка в отдельном файле не прерывает обработку
+// архива, а сохраняется в результате этого файла; превышение ограничений прерывает загрузку целиком
+func loadArchive(writer *copyOffersWriter, filePath string, sheet string, sellerId int, options importOptions,
+	maxRows int) ([]TaskFile, loadCounters, error) {
+	var total loadCounters
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, total, errInvalidArchive
+	}
+	defer archive.Close()
+	if len(archive.File) > maxArchiveEntries {
+		return nil, total, errArchiveTooManyEntries
+	}
+
+	var files []TaskFile
+	budget, rowsLeft, loaded := maxArchiveBytes, maxRows, false
+	for _, entry := range archive.File {
+		if skippedArchiveEntry(entry) {
+			continue
+		}
+		taskFile := TaskFile{FileName: truncateString(entry.Name, 1024)}
+		switch strings.ToLower(path.Ext(entry.Name)) {
+		case ".xlsx", ".xls", ".ods", ".csv", ".yml", ".xml":
+		default:
+			message := "неподдерживаемый формат файла"
+			taskFile.ErrorMessage = &message
+			files = append(files, taskFile)
+			continue
+		}
+
+		file, err := extractArchiveFile(entry, &budget)
+		if err != nil {
+			return nil, total, err
+		}
+		selection := newSheetSelection(sheet)
+		counters, rowCount, err := loadFile(writer, file, selection, sellerId, options, rowsLeft)
+		file.Remove()
+		switch {
+		case err == nil:
+			taskFile.setCounters(counters)
+			taskFile.Sheets = selection.Report()
+			total.add(counters)
+			rowsLeft -= rowCount
+			loaded = true
+		case err == errNoValidRows || invalidFileFormat(err):
+			if discardErr := writer.Discard(); discardErr != nil {
+				return nil, total, discardErr
+			}
+			message := fileErrorMessage(err)
+			taskFile.ErrorMessage = &message
+		default:
+			return nil, total, err
+		}
+		files = append(files, taskFile)
+	}
+	if !loaded {
+		return nil, total, errNoValidRows
+	}
+	return files, total, nil
+}
+
+// Сохранить результаты обработки файлов архива
+func insertTaskFiles(tx *sql.Tx, taskId int, files []TaskFile) error {
+	for index, file := range files {
+		var sheetsRead, sheetsSkipped interface{}
+		if file.Sheets != nil {
+			sheetsRead, sheetsSkipped = pq.Array(file.Sheets.Read), pq.Array(file.Sheets.Skipped)
+		}
+		_, err := tx.Exec("SELECT offers.insert_task_file($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);", taskId, index,
+			file.FileName, file.NumErrors, file.NumCreated, file.NumUpdated, file.NumDeleted, file.ErrorMessage,
+			sheetsRead, sheetsSkipped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Результаты обработки файлов архива для задачи
+func loadTaskFiles(db *sql.DB, taskId int) ([]TaskFile, error) {
+	rows, err := db.Query(`SELECT file_name, num_errors, num_created, num_updated, num_deleted, error_message,
+                                  sheets_read, sheets_skipped
+                           FROM offers.get_task_files($1);`, taskId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []TaskFile
+	for rows.Next() {
+		var file TaskFile
+		var sheetsRead, sheetsSkipped pq.StringArray
+		err = rows.Scan(&file.FileName, &file.NumErrors, &file.NumCreated, &file.NumUpdated, &file.NumDeleted, &file.ErrorMessage,
+			&sheetsRead, &sheetsSkipped)
+		if err != nil {
+			return nil, err
+		}
+		if sheetsRead != nil {
+			file.Sheets = &SheetReport{Read: sheetsRead, Skipped: sheetsSkipped}
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// Обрезать строку до заданного количества символов
+func truncateString(value string, length int) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+	return string(runes[:length])
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errInvalidAttribute = errors.New("некорректное значение атрибута")
+
+// столбцы 1-10 файла заняты основными полями товара
+const firstAttributeColumn = 11
+const maxAttributeColumns = 50
+
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// Дополнительный атрибут товара (бренд, штрихкод, вес и т.п.), читаемый из столбца файла
+type AttributeColumn struct {
+	// номер столбца в файле, начиная с 1
+	Column int    `json:"column"`
+	Name   string `json:"name"`
+	// тип значения: string, number или boolean
+	Type string `json:"type"`
+}
+
+// Значения дополнительных атрибутов товара, хранятся в offers.Offer.attributes (JSONB)
+type Attributes map[string]interface{}
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a *Attributes) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(value, a)
+	case string:
+		return json.Unmarshal([]byte(value), a)
+	}
+	return fmt.Errorf("неподдерживаемый тип значения атрибутов %T", src)
+}
+
+// Настройки продавца, применяемые к строкам загружаемых файлов
+type importOptions struct {
+	// валюта для строк, в которых она не указана
+	Currency string
+	// столбцы дополнительных атрибутов товара
+	Attributes []AttributeColumn
+	// номер столбца с адресами изображений, 0 -- изображения не загружаются
+	PictureColumn int
+}
+
+func sellerImportOptions(db *sql.DB, sellerId int) (importOptions, error) {
+	options := importOptions{Currency: defaultCurrency}
+	settings, err := loadSellerSettings(db, sellerId)
+	if err != nil {
+		return options, err
+	}
+	if settings.Currency != nil {
+		options.Currency = *settings.Currency
+	}
+	options.Attributes = settings.Attributes
+	if settings.PictureColumn != nil {
+		options.PictureColumn = *settings.PictureColumn
+	}
+	return options, nil
+}
+
+// Проверить описание столбцов атрибутов из настроек продавца
+func validAttributeColumns(columns []AttributeColumn) bool {
+	if len(columns) > maxAttributeColumns {
+		return false
+	}
+	names, numbers := map[string]bool{}, map[int]bool{}
+	for _, column := range columns {
+		if column.Column < firstAttributeColumn || column.Column > 16384 || numbers[column.Column] {
+			return false
+		}
+		if !attributeNamePattern.MatchString(column.Name) || names[column.Name] {
+			return false
+		}
+		switch column.Type {
+		case "string", "number", "boolean":
+		default:
+			return false
+		}
+		names[column.Name], numbers[column.Column] = true, true
+	}
+	return true
+}
+
+// Значение атрибута из ячейки в соответствии с типом атрибута
+func parseAttribute(column AttributeColumn, value string) (interface{}, error) {
+	switch column.Type {
+	case "number":
+		number, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+		// NaN и бесконечность не сохраняются в JSON
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, errInvalidAttribute
+		}
+		return number, nil
+	case "boolean":
+		if value == "true" || value == "false" {
+			return value == "true", nil
+		}
+		return nil, errInvalidAttribute
+	}
+	if len([]rune(value)) > 1024 {
+		return nil, errInvalidAttribute
+	}
+	return value, nil
+}
+
+// Атрибуты товара из строки файла, пустые ячейки пропускаются. nil -- у товара нет атрибутов
+func AttributesFromCells(cells []string, columns []AttributeColumn) (Attributes, error) {
+	var attributes Attributes
+	for _, column := range columns {
+		value := strings.TrimSpace(cellValue(cells, column.Column-1))
+		if value == "" {
+			continue
+		}
+		parsed, err := parseAttribute(column, value)
+		if err != nil {
+			return nil, err
+		}
+		if attributes == nil {
+			attributes = Attributes{}
+		}
+		attributes[column.Name] = parsed
+	}
+	return attributes, nil
+}
+
+// Проверить фильтр по атрибутам для поиска: значения должны быть строками, числами или true/false
+func validAttributesFilter(filter Attributes) bool {
+	for name, value := range filter {
+		if !attributeNamePattern.MatchString(name) {
+			return false
+		}
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+// количество строк, передаваемых в базу за один запрос при загрузке через JSON
+const offersChunkSize = 1000
+
+// Счетчики результата загрузки товаров
+type loadCounters struct {
+	Created int
+	Updated int
+	Deleted int
+	Errors  int
+}
+
+func (c *loadCounters) add(other loadCounters) {
+	c.Created += other.Created
+	c.Updated += other.Updated
+	c.Deleted += other.Deleted
+	c.Errors += other.Errors
+}
+
+// Способ записи корректных строк файла в offers.Offer в рамках транзакции
+type offersWriter interface {
+	Write(offer ExcelOffer) error
+	// Завершить запись и вернуть счетчики созданных, обновленных и удаленных товаров
+	Finish() (loadCounters, error)
+}
+
+// Запись через COPY во временную таблицу задачи с последующим слиянием с offers.Offer.
+// После Finish таблица очищается, и writer можно использовать для следующего файла
+type copyOffersWriter struct {
+	tx    *sql.Tx
+	table string
+	stmt  *sql.Stmt
+}
+
+func newCopyOffersWriter(tx *sql.Tx, taskId int) (*copyOffersWriter, error) {
+	table := fmt.Sprintf("staging_offer_%d", taskId)
+	query := fmt.Sprintf(`CREATE TEMP TABLE %s
+                          (
+                              offer_id   INT,
+                              offer_name VARCHAR(255),
+                              price      NUMERIC(12, 2),
+                              quantity   INT,
+                              seller_id  INT,
+                              available  BOOL,
+                              currency   CHAR(3),
+                              old_price  NUMERIC(12, 2),
+                              discount_from TIMESTAMP,
+                              discount_to   TIMESTAMP,
+                              category_id   INT,
+                              attributes    JSONB,
+                              pictures      TEXT[]
+                          ) ON COMMIT DROP;`, pq.QuoteIdentifier(table))
+	if _, err := tx.Exec(query); err != nil {
+		return nil, err
+	}
+	return &copyOffersWriter{tx: tx, table: table}, nil
+}
+
+func (w *copyOffersWriter) Write(offer ExcelOffer) error {
+	if w.stmt == nil {
+		stmt, err := w.tx.Prepare(pq.CopyIn(w.table, "offer_id", "offer_name", "price", "quantity", "seller_id", "available",
+			"currency", "old_price", "discount_from", "discount_to", "category_id",
+			"attributes", "pictures"))
+		if err != nil {
+			return err
+		}
+		w.stmt = stmt
+	}
+	_, err := w.stmt.Exec(offer.OfferId, offer.Name, offer.Price, offer.Quantity, offer.SellerId, offer.Available,
+		offer.Currency, offer.OldPrice, offer.DiscountFrom, offer.DiscountTo, offer.CategoryId,
+		offer.Attributes, pq.Array(offer.Pictures))
+	return err
+}
+
+// Завершить COPY, если он был начат
+func (w *copyOffersWriter) closeCopy() error {
+	if w.stmt == nil {
+		return nil
+	}
+	stmt := w.stmt
+	w.stmt = nil
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func (w *copyOffersWriter) truncate() error {
+	_, err := w.tx.Exec("TRUNCATE " + pq.QuoteIdentifier(w.table) + ";")
+	return err
+}
+
+func (w *copyOffersWriter) Finish() (loadCounters, error) {
+	var counters loadCounters
+	if err := w.closeCopy(); err != nil {
+		return counters, err
+	}
+	query := "SELECT num_created, num_updated, num_deleted, num_errors FROM offers.merge_staging_offers($1);"
+	err := w.tx.QueryRow(query, w.table).Scan(&counters.Created, &counters.Updated, &counters.Deleted, &counters.Errors)
+	if err != nil {
+		return counters, err
+	}
+	return counters, w.truncate()
+}
+
+// Отбросить строки, записанные после последнего вызова Finish
+func (w *copyOffersWriter) Discard() error {
+	if err := w.closeCopy(); err != nil {
+		return err
+	}
+	return w.truncate()
+}
+
+// Запись порциями по offersChunkSize строк в формате JSON через offers.load_offers
+type jsonOffersWriter struct {
+	stmt     *sql.Stmt
+	chunk    []ExcelOffer
+	counters loadCounters
+}
+
+func newJsonOffersWriter(tx *sql.Tx) (*jsonOffersWriter, error) {
+	stmt, err := tx.Prepare("SELECT num_created, num_updated, num_deleted, num_errors FROM offers.load_offers($1);")
+	if err != nil {
+		return nil, err
+	}
+	return &jsonOffersWriter{stmt: stmt, chunk: make([]ExcelOffer, 0, offersChunkSize)}, nil
+}
+
+func (w *jsonOffersWriter) flush() error {
+	if len(w.chunk) == 0 {
+		return nil
+	}
+	jsonOffers, err := json.Marshal(w.chunk)
+	if err != nil {
+		return err
+	}
+	w.chunk = w.chunk[:0]
+	var counters loadCounters
+	err = w.stmt.QueryRow(jsonOffers).Scan(&counters.Created, &counters.Updated, &counters.Deleted, &counters.Errors)
+	if err != nil {
+		return err
+	}
+	w.counters.add(counters)
+	return nil
+}
+
+func (w *jsonOffersWriter) Write(offer ExcelOffer) error {
+	w.chunk = append(w.chunk, offer)
+	if len(w.chunk) == offersChunkSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *jsonOffersWriter) Finish() (loadCounters, error) {
+	defer w.stmt.Close()
+	err := w.flush()
+	return w.counters, err
+}
+
+// Завершить задачу, сохранив итоговые счетчики
+func finishTask(tx *sql.Tx, taskId int, counters loadCounters) error {
+	_, err := tx.Exec("SELECT offers.finish_task($1, $2, $3, $4, $5);",
+		taskId, counters.Errors, counters.Created, counters.Updated, counters.Deleted)
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Категория товаров из общего для всех продавцов дерева категорий
+type Category struct {
+	CategoryId   int    `json:"category_id"`
+	CategoryName string `json:"category_name"`
+	ParentId     *int   `json:"parent_id"`
+}
+
+// Проверить существование категории с идентификатором из url
+func categoryFromParams(r *http.Request) (int, bool, error) {
+	categoryId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, false, nil
+	}
+	exists, err := categoryExists(db, categoryId)
+	return categoryId, exists, err
+}
+
+func categoryExists(db *sql.DB, categoryId int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT * FROM offers.Category WHERE category_id = $1);", categoryId).Scan(&exists)
+	return exists, err
+}
+
+func loadCategory(db *sql.DB, categoryId int) (*Category, error) {
+	var category Category
+	err := db.QueryRow("SELECT category_id, category_name, parent_id FROM offers.Category WHERE category_id = $1;",
+		categoryId).Scan(&category.CategoryId, &category.CategoryName, &category.ParentId)
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// Прочитать категорию из тела запроса и проверить ее. categoryId -- изменяемая категория, 0 -- новая категория.
+// Вернет false, если ответ клиенту уже отправлен
+func readCategory(w http.ResponseWriter, r *http.Request, categoryId int) (*Category, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return nil, false
+	}
+	var category Category
+	err = json.Unmarshal(body, &category)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return nil, false
+	}
+	category.CategoryName = strings.TrimSpace(category.CategoryName)
+	if category.CategoryName == "" || len([]rune(category.CategoryName)) > 255 {
+		sendErrorMessage(w, "Неверный формат category_name! Ожидается не пустая строка не длиннее 255 символов",
+			http.StatusBadRequest)
+		return nil, false
+	}
+
+	if category.ParentId != nil {
+		exists, err := categoryExists(db, *category.ParentId)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return nil, false
+		}
+		if !exists {
+			sendErrorMessage(w, "Категория с указанным ParentId не существует!", http.StatusBadRequest)
+			return nil, false
+		}
+		// категорию нельзя перенести в нее саму или в ее подкатегорию
+		var cycle bool
+		err = db.QueryRow("SELECT EXISTS(SELECT * FROM offers.category_tree($1) WHERE category_id = $2);",
+			categoryId, *category.ParentId).Scan(&cycle)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return nil, false
+		}
+		if cycle {
+			sendErrorMessage(w, "Категорию нельзя вложить в нее саму или в ее подкатегорию!", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	var alreadyExists bool
+	query := `SELECT EXISTS(SELECT * FROM offers.Category
+                            WHERE parent_id IS NOT DISTINCT FROM $1 AND LOWER(category_name) = LOWER($2)
+                              AND category_id <> $3);`
+	err = db.QueryRow(query, category.ParentId, category.CategoryName, categoryId).Scan(&alreadyExists)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return nil, false
+	}
+	if alreadyExists {
+		sendErrorMessage(w, "Категория с указанным CategoryName уже существует!", http.StatusBadRequest)
+		return nil, false
+	}
+	return &category, true
+}
+
+func sendCategory(w http.ResponseWriter, categoryId int, statusCode int) {
+	category, err := loadCategory(db, categoryId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	err = json.NewEncoder(w).Encode(category)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func getAllCategories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	result, err := db.Query("SELECT category_id, category_name, parent_id FROM offers.Category ORDER BY category_id;")
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer result.Close()
+	categories := make([]Category, 0)
+	for result.Next() {
+		var category Category
+		err = result.Scan(&category.CategoryId, &category.CategoryName, &category.ParentId)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		categories = append(categories, category)
+	}
+	if err = result.Err(); err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string][]Category{"categories": categories})
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func getCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	categoryId, exists, err := categoryFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorMessage(w, "Категория с указанным CategoryId не существует!", http.StatusBadRequest)
+		return
+	}
+	sendCategory(w, categoryId, http.StatusOK)
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !checkAdminToken(w, r) {
+		return
+	}
+	category, ok := readCategory(w, r, 0)
+	if !ok {
+		return
+	}
+	var categoryId int
+	err := db.QueryRow("SELECT offers.insert_category($1, $2);", category.CategoryName, category.ParentId).
+		Scan(&categoryId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	sendCategory(w, categoryId, http.StatusCreated)
+}
+
+// Переименовать категорию или перенести ее в другую родительскую категорию
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !checkAdminToken(w, r) {
+		return
+	}
+	categoryId, exists, err := categoryFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorMessage(w, "Категория с указанным CategoryId не существует!", http.StatusBadRequest)
+		return
+	}
+	category, ok := readCategory(w, r, categoryId)
+	if !ok {
+		return
+	}
+	_, err = db.Exec("UPDATE offers.Category SET category_name = $2, parent_id = $3 WHERE category_id = $1;",
+		categoryId, category.CategoryName, category.ParentId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	sendCategory(w, categoryId, http.StatusOK)
+}
+
+// Удалить категорию без подкатегорий, у товаров удаленной категории категория сбрасывается
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !checkAdminToken(w, r) {
+		return
+	}
+	categoryId, exists, err := categoryFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorMessage(w, "Категория с указанным CategoryId не существует!", http.StatusBadRequest)
+		return
+	}
+	var hasChildren bool
+	err = db.QueryRow("SELECT EXISTS(SELECT * FROM offers.Category WHERE parent_id = $1);", categoryId).Scan(&hasChildren)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if hasChildren {
+		sendErrorMessage(w, "Категория содержит подкатегории!", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("DELETE FROM offers.Category WHERE category_id = $1;", categoryId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
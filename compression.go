@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("неподдерживаемое значение Content-Encoding")
+var errInvalidEncoding = errors.New("некорректные сжатые данные в теле запроса")
+var errInvalidGzip = errors.New("некорректный формат gzip файла")
+
+var gzipSignature = []byte{0x1f, 0x8b}
+
+// Распакованное тело запроса. failed -- при чтении сжатых данных произошла ошибка
+type decodedBody struct {
+	reader     io.Reader
+	body       io.ReadCloser
+	compressed bool
+	failed     bool
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF && b.compressed {
+		b.failed = true
+	}
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+// Распаковать тело запроса в соответствии с заголовком Content-Encoding (gzip или br)
+func decodeRequestBody(r *http.Request) (*decodedBody, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return &decodedBody{reader: r.Body, body: r.Body}, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errInvalidEncoding
+		}
+		return &decodedBody{reader: reader, body: r.Body, compressed: true}, nil
+	case "br":
+		return &decodedBody{reader: brotli.NewReader(r.Body), body: r.Body, compressed: true}, nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// Проверить, сжат ли файл gzip
+func isGzipFile(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	signature := make([]byte, len(gzipSignature))
+	if _, err = io.ReadFull(file, signature); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(signature, gzipSignature), nil
+}
+
+// Распаковать сжатый gzip файл (например, .csv.gz или .xlsx.gz) во временный файл не более limit байт
+func gunzipUpload(file *uploadedFile, limit int64) (*uploadedFile, error) {
+	compressed, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer compressed.Close()
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, errInvalidGzip
+	}
+	name := file.Name
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		name = name[:len(name)-len(".gz")]
+	}
+	unpacked, err := saveUpload(reader, name, limit)
+	if err != nil && err != errFileTooLarge {
+		return nil, errInvalidGzip
+	}
+	return unpacked, err
+}
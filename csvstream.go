@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+var errInvalidCsv = errors.New("некорректный формат csv файла")
+
+// Потоковое чтение строк csv файла в кодировке UTF-8. Разделитель (запятая, точка с запятой
+// или табуляция) определяется по первой строке файла
+type csvRows struct {
+	file   *os.File
+	reader *csv.Reader
+}
+
+// Определить разделитель по количеству вхождений в первой строке вне кавычек
+func detectCsvDelimiter(line []byte) rune {
+	counts := map[rune]int{}
+	quoted := false
+	for _, r := range string(line) {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',', ';', '\t':
+			if !quoted {
+				counts[r]++
+			}
+		}
+	}
+	delimiter := ','
+	for _, candidate := range []rune{';', '\t'} {
+		if counts[candidate] > counts[delimiter] {
+			delimiter = candidate
+		}
+	}
+	return delimiter
+}
+
+// Открыть csv файл для потокового чтения
+func openCsvRows(filePath string) (*csvRows, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(file)
+	if bom, err := buffered.Peek(3); err == nil && bytes.Equal(bom, []byte{0xEF, 0xBB, 0xBF}) {
+		buffered.Discard(3)
+	}
+	firstLine, _ := buffered.Peek(buffered.Size())
+	if index := bytes.IndexByte(firstLine, '\n'); index >= 0 {
+		firstLine = firstLine[:index]
+	}
+	if !utf8.Valid(firstLine) && len(firstLine) < buffered.Size() {
+		file.Close()
+		return nil, errInvalidCsv
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.Comma = detectCsvDelimiter(firstLine)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	return &csvRows{file: file, reader: reader}, nil
+}
+
+// Следующая строка файла
+func (c *csvRows) Next() ([]string, error) {
+	record, err := c.reader.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errInvalidCsv
+	}
+	for _, value := range record {
+		if !utf8.ValidString(value) {
+			return nil, errInvalidCsv
+		}
+	}
+	return record, nil
+}
+
+func (c *csvRows) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var errInvalidCurrency = errors.New("некорректный код валюты")
+
+// валюта цен по умолчанию и валюта, к которой приводятся цены при поиске
+const defaultCurrency = "RUB"
+
+// токен для методов администрирования, пустое значение -- проверка не выполняется
+var adminToken string
+
+// действующие коды валют ISO 4217
+var iso4217Currencies = map[string]bool{}
+
+func init() {
+	codes := `AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD
+		CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF
+		GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP
+		LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB
+		PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL
+		THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`
+	for _, code := range strings.Fields(codes) {
+		iso4217Currencies[code] = true
+	}
+}
+
+// Привести код валюты к верхнему регистру и проверить, что он есть в ISO 4217
+func parseCurrency(value string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(value))
+	if !iso4217Currencies[code] {
+		return "", errInvalidCurrency
+	}
+	return code, nil
+}
+
+// Курс валюты: стоимость единицы валюты в рублях
+type ExchangeRate struct {
+	Currency  string  `json:"currency"`
+	Rate      float64 `json:"rate"`
+	UpdatedAt *string `json:"updated_at,omitempty"`
+}
+
+// Проверить токен администратора в заголовке Authorization. Если ADMIN_TOKEN не задан,
+// административные методы недоступны
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		sendErrorMessage(w, "административные методы недоступны: не задан ADMIN_TOKEN", http.StatusServiceUnavailable)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		sendErrorMessage(w, "доступ запрещен", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func loadExchangeRates(db *sql.DB) ([]ExchangeRate, error) {
+	rows, err := db.Query("SELECT currency, rate, updated_at FROM offers.ExchangeRate ORDER BY currency;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := make([]ExchangeRate, 0)
+	for rows.Next() {
+		var rate ExchangeRate
+		if err = rows.Scan(&rate.Currency, &rate.Rate, &rate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+func sendExchangeRates(w http.ResponseWriter) {
+	rates, err := loadExchangeRates(db)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string][]ExchangeRate{"rates": rates})
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !checkAdminToken(w, r) {
+		return
+	}
+	sendExchangeRates(w)
+}
+
+// Загрузить курсы валют. Переданные курсы добавляются или заменяют существующие
+func setExchangeRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !checkAdminToken(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	var input struct {
+		Rates []ExchangeRate `json:"rates"`
+	}
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return
+	}
+	for i, rate := range input.Rates {
+		currency, err := parseCurrency(rate.Currency)
+		if err != nil || currency == defaultCurrency {
+			sendErrorMessage(w, "некорректный код валюты "+rate.Currency, http.StatusBadRequest)
+			return
+		}
+		if rate.Rate <= 0 {
+			sendErrorMessage(w, "недопустимое значение курса валюты "+currency, http.StatusBadRequest)
+			return
+		}
+		input.Rates[i].Currency = currency
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for _, rate := range input.Rates {
+		if _, err = tx.Exec("SELECT offers.set_exchange_rate($1, $2);", rate.Currency, rate.Rate); err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	sendExchangeRates(w)
+}
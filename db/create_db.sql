@@ -1,21 +1,40 @@
 CREATE SCHEMA offers;
 
+-- нечеткий поиск по названию товара
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TYPE offers.ExcelOffer AS
 (
     offer_id INT,
     offer_name VARCHAR(255),
-    price INT,
+    price NUMERIC(12, 2),
     quantity INT,
     seller_id INT,
-    available bool
+    available bool,
+    currency CHAR(3),
+    old_price NUMERIC(12, 2),
+    discount_from TIMESTAMP,
+    discount_to TIMESTAMP,
+    category_id INT,
+    attributes JSONB,
+    pictures TEXT[]
 );
 
 CREATE TYPE offers.OutputOffer AS
 (
     offer_id INT,
     offer_name VARCHAR(255),
-    price INT,
+    price NUMERIC(12, 2),
     quantity INT,
+    currency CHAR(3),
+    price_rub NUMERIC(12, 2),
+    old_price NUMERIC(12, 2),
+    discount_to TIMESTAMP,
+    category_id INT,
+    attributes JSONB,
+    pictures TEXT[],
+    highlight TEXT,
+    relevance REAL,
     seller_id INT,
     seller_name VARCHAR(255)
 );
@@ -32,7 +51,10 @@ CREATE TYPE offers.TaskInfo AS
     num_deleted INT,
     seller_id INT,
     seller_name VARCHAR(255),
-    created_at TIMESTAMP
+    created_at TIMESTAMP,
+    source_url VARCHAR(2048),
+    file_size INT,
+    error_message VARCHAR(1024)
 );
 
 CREATE TABLE offers.Seller
@@ -53,19 +75,116 @@ CREATE TABLE offers.Task
     num_created INT NULL,
     num_updated INT NULL,
     num_deleted INT NULL,
-    CONSTRAINT CK_Status CHECK ( status IN ('Выполняется', 'Завершен', 'Ошибка') )
+    source_url  VARCHAR(2048) NULL,
+    file_size   INT NULL,
+    error_message VARCHAR(1024) NULL,
+    file_hash   CHAR(64) NULL,
+    sheet       VARCHAR(255) NULL,
+    sheets_read    TEXT[] NULL,
+    sheets_skipped TEXT[] NULL,
+    CONSTRAINT CK_Status CHECK ( status IN ('Скачивание', 'Выполняется', 'Завершен', 'Без изменений', 'Ошибка') )
+);
+
+CREATE INDEX IX_Task_Seller ON offers.Task (seller_id, status, finish_date);
+
+-- Общее для всех продавцов дерево категорий товаров
+CREATE TABLE offers.Category
+(
+    category_id   SERIAL PRIMARY KEY,
+    category_name VARCHAR(255) NOT NULL,
+    parent_id     INT NULL REFERENCES offers.Category (category_id)
 );
 
+CREATE UNIQUE INDEX UX_Category_Name ON offers.Category (COALESCE(parent_id, 0), LOWER(category_name));
+CREATE INDEX IX_Category_Parent ON offers.Category (parent_id);
+
+-- Товар, предлагаемый разными продавцами. Предложения сопоставляются с товаром по штрихкоду
+-- (атрибут barcode), а при его отсутствии -- по сходству нормализованного названия name_key
+CREATE TABLE offers.Product
+(
+    product_id   INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    product_name VARCHAR(255) NOT NULL,
+    barcode      VARCHAR(1024) NULL UNIQUE,
+    name_key     VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX IX_Product_NameKey ON offers.Product USING GIN (name_key gin_trgm_ops);
+
 CREATE TABLE offers.Offer
 (
     offer_id   INT,
     offer_name VARCHAR(255) NOT NULL,
-    price      INT          NOT NULL,
+    price      NUMERIC(12, 2) NOT NULL,
     quantity   INT          NOT NULL,
+    currency   CHAR(3)      NOT NULL DEFAULT 'RUB',
+    -- старая (зачеркнутая) цена и период действия скидки, NULL -- без ограничения
+    old_price     NUMERIC(12, 2) NULL,
+    discount_from TIMESTAMP NULL,
+    discount_to   TIMESTAMP NULL,
+    category_id   INT NULL REFERENCES offers.Category (category_id) ON DELETE SET NULL,
+    -- дополнительные атрибуты товара из столбцов, заданных в настройках продавца
+    attributes    JSONB NULL,
+    -- название товара для полнотекстового поиска
+    name_tsv      TSVECTOR GENERATED ALWAYS AS (to_tsvector('russian', offer_name)) STORED,
+    -- товар, NULL -- предложение еще не сопоставлено
+    product_id    INT NULL REFERENCES offers.Product (product_id) ON DELETE SET NULL,
     seller_id  INT REFERENCES offers.Seller (seller_id),
-    CONSTRAINT PK_Offer PRIMARY KEY (offer_id, seller_id)
+    CONSTRAINT PK_Offer PRIMARY KEY (offer_id, seller_id),
+    CONSTRAINT CK_Offer_OldPrice CHECK ( old_price > price )
 );
 
+CREATE INDEX IX_Offer_Category ON offers.Offer (category_id);
+CREATE INDEX IX_Offer_Product ON offers.Offer (product_id);
+-- предложения, ожидающие сопоставления с товаром
+CREATE INDEX IX_Offer_Unmatched ON offers.Offer (seller_id, offer_id) WHERE product_id IS NULL;
+-- сортировка результатов поиска по названию, в том числе в рамках продавца
+CREATE INDEX IX_Offer_Name ON offers.Offer (offer_name, seller_id, offer_id);
+CREATE INDEX IX_Offer_Seller ON offers.Offer (seller_id, offer_name, offer_id);
+CREATE INDEX IX_Offer_Attributes ON offers.Offer USING GIN (attributes jsonb_path_ops);
+-- полнотекстовый поиск, а также нечеткий поиск и поиск по подстроке в названии товара
+CREATE INDEX IX_Offer_NameTsv ON offers.Offer USING GIN (name_tsv);
+CREATE INDEX IX_Offer_NameTrgm ON offers.Offer USING GIN (offer_name gin_trgm_ops);
+-- подсказки по началу названия товара без учета регистра, в том числе в рамках продавца
+CREATE INDEX IX_Offer_NameLower ON offers.Offer ((LOWER(offer_name) COLLATE "C"));
+CREATE INDEX IX_Offer_SellerNameLower ON offers.Offer (seller_id, (LOWER(offer_name) COLLATE "C"));
+
+-- Изображения товаров в порядке position, broken -- изображение недоступно по результатам проверки
+CREATE TABLE offers.OfferPicture
+(
+    seller_id  INT           NOT NULL,
+    offer_id   INT           NOT NULL,
+    position   INT           NOT NULL,
+    url        VARCHAR(2048) NOT NULL,
+    broken     BOOL          NOT NULL DEFAULT FALSE,
+    checked_at TIMESTAMP NULL,
+    CONSTRAINT PK_OfferPicture PRIMARY KEY (seller_id, offer_id, position),
+    CONSTRAINT FK_OfferPicture_Offer FOREIGN KEY (offer_id, seller_id)
+        REFERENCES offers.Offer (offer_id, seller_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IX_OfferPicture_CheckedAt ON offers.OfferPicture (checked_at NULLS FIRST);
+
+-- Курсы валют: стоимость единицы валюты в рублях
+CREATE TABLE offers.ExchangeRate
+(
+    currency   CHAR(3) PRIMARY KEY,
+    rate       NUMERIC(18, 6) NOT NULL CHECK ( rate > 0 ),
+    updated_at TIMESTAMP      NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE
+OR REPLACE FUNCTION offers.set_exchange_rate(_currency CHAR(3), _rate NUMERIC(18, 6)) RETURNS VOID AS
+$$
+BEGIN
+INSERT INTO offers.ExchangeRate(currency, rate)
+VALUES (_currency, _rate)
+ON CONFLICT (currency) DO UPDATE
+SET rate       = EXCLUDED.rate,
+    updated_at = CURRENT_TIMESTAMP;
+END;
+$$
+LANGUAGE plpgsql;
+
 CREATE
 OR REPLACE FUNCTION offers.insert_seller(_seller_name VARCHAR(255)) RETURNS INT AS
     $$
@@ -77,58 +196,496 @@ END;
     $$
 LANGUAGE plpgsql;
 
+CREATE
+OR REPLACE FUNCTION offers.insert_category(_category_name VARCHAR(255), _parent_id INT DEFAULT NULL) RETURNS INT AS
+    $$
+BEGIN
+INSERT INTO offers.Category(category_name, parent_id)
+VALUES (_category_name, _parent_id);
+RETURN currval('offers.category_category_id_seq');
+END;
+    $$
+LANGUAGE plpgsql;
+
+-- Действующая цена товара на текущий момент: цена со скидкой, если скидка действует,
+-- иначе старая цена (если она задана). Функция на SQL, возвращающая набор строк, встраивается
+-- планировщиком в запросы (CROSS JOIN LATERAL) и не вызывается для каждой строки
+CREATE
+OR REPLACE FUNCTION offers.effective_price(_price NUMERIC, _old_price NUMERIC, _discount_from TIMESTAMP,
+                                           _discount_to TIMESTAMP) RETURNS TABLE (price NUMERIC, discount BOOL) AS
+$$
+SELECT CASE WHEN D.discount OR _old_price IS NULL THEN _price ELSE _old_price END, D.discount
+FROM (SELECT _old_price IS NOT NULL
+                 AND (_discount_from IS NULL OR _discount_from <= LOCALTIMESTAMP)
+                 AND (_discount_to IS NULL OR LOCALTIMESTAMP < _discount_to) AS discount) AS D;
+$$
+LANGUAGE sql STABLE;
+
+-- Категория и все ее подкатегории
+CREATE
+OR REPLACE FUNCTION offers.category_tree(_category_id INT) RETURNS TABLE (category_id INT) AS
+$$
+BEGIN
+RETURN QUERY
+WITH RECURSIVE tree AS (
+    SELECT C.category_id FROM offers.Category AS C WHERE C.category_id = _category_id
+    UNION
+    SELECT C.category_id FROM offers.Category AS C JOIN tree AS T ON C.parent_id = T.category_id
+)
+SELECT T.category_id FROM tree AS T;
+END;
+$$
+LANGUAGE plpgsql STABLE;
+
+-- Условие отбора товаров для поиска по псевдонимам O (offers.Offer), P (offers.effective_price)
+-- и R (offers.ExchangeRate)
+CREATE
+OR REPLACE FUNCTION offers.offers_filter(_seller_id INT, _offer_id INT, _offer_name VARCHAR, _ignore_register BOOL,
+                                     _category_id INT, _attributes JSONB, _seller_ids INT[],
+                                     _min_price NUMERIC, _max_price NUMERIC, _min_quantity INT,
+                                     _in_stock_only BOOL, _match VARCHAR, _product_id INT) RETURNS TEXT AS
+$$
+DECLARE
+-- цена в рублях, товары без курса валюты не попадают в отбор по цене
+_price_rub TEXT := 'CASE WHEN O.currency = ''RUB'' THEN P.price ELSE ROUND(P.price * R.rate, 2) END';
+BEGIN
+RETURN 'TRUE'
+    || CASE WHEN _seller_id IS NOT NULL THEN ' AND O.seller_id = ' || _seller_id ELSE '' END
+    || CASE WHEN _seller_ids IS NOT NULL
+        THEN ' AND O.seller_id = ANY(' || quote_literal(_seller_ids::TEXT) || '::INT[])'
+        ELSE '' END
+    || CASE WHEN _min_price IS NOT NULL THEN ' AND ' || _price_rub || ' >= ' || _min_price ELSE '' END
+    || CASE WHEN _max_price IS NOT NULL THEN ' AND ' || _price_rub || ' <= ' || _max_price ELSE '' END
+    || CASE WHEN _min_quantity IS NOT NULL THEN ' AND O.quantity >= ' || _min_quantity ELSE '' END
+    || CASE WHEN _in_stock_only = TRUE THEN ' AND O.quantity > 0' ELSE '' END
+    || CASE WHEN _offer_id IS NOT NULL THEN ' AND O.offer_id = ' || _offer_id ELSE '' END
+    || CASE WHEN _product_id IS NOT NULL THEN ' AND O.product_id = ' || _product_id ELSE '' END
+    || CASE WHEN _category_id IS NOT NULL
+        THEN ' AND O.category_id IN (SELECT category_id FROM offers.category_tree(' || _category_id || '))'
+        ELSE '' END
+    || CASE WHEN _attributes IS NOT NULL
+        THEN ' AND O.attributes @> ' || quote_literal(_attributes::TEXT) || '::JSONB'
+        ELSE '' END
+    || CASE WHEN _offer_name IS NULL THEN ''
+            WHEN _match = 'fulltext'
+                THEN ' AND O.name_tsv @@ websearch_to_tsquery(''russian'', ' || quote_literal(_offer_name) || ')'
+            WHEN _match = 'fuzzy'
+                THEN ' AND ' || quote_literal(_offer_name) || ' <% O.offer_name'
+            ELSE ' AND O.offer_name' || CASE WHEN _ignore_register = TRUE THEN ' ILIKE ' ELSE ' LIKE ' END
+                 || quote_literal('%' || _offer_name || '%')
+        END;
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
+-- Релевантность товара для полнотекстового (ts_rank) и нечеткого (word_similarity) поиска
+-- по названию, для поиска по подстроке -- NULL
+CREATE
+OR REPLACE FUNCTION offers.offers_relevance(_offer_name VARCHAR, _match VARCHAR) RETURNS TEXT AS
+$$
+BEGIN
+RETURN CASE WHEN _offer_name IS NULL THEN 'NULL::REAL'
+            WHEN _match = 'fulltext'
+                THEN 'ts_rank(O.name_tsv, websearch_to_tsquery(''russian'', ' || quote_literal(_offer_name) || '))'
+            WHEN _match = 'fuzzy' THEN 'word_similarity(' || quote_literal(_offer_name) || ', O.offer_name)'
+            ELSE 'NULL::REAL'
+    END;
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
+-- Название товара с выделенными словами запроса для полнотекстового поиска
+CREATE
+OR REPLACE FUNCTION offers.offers_highlight(_offer_name VARCHAR, _match VARCHAR) RETURNS TEXT AS
+$$
+BEGIN
+RETURN CASE WHEN _offer_name IS NOT NULL AND _match = 'fulltext'
+                THEN 'ts_headline(''russian'', O.offer_name, websearch_to_tsquery(''russian'', '
+                         || quote_literal(_offer_name) || '), ''StartSel=<b>, StopSel=</b>, HighlightAll=TRUE'')'
+            ELSE 'NULL::TEXT'
+    END;
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
+-- Порядок сортировки результатов поиска: name, price (цена в рублях), quantity или seller,
+-- с префиксом "-" -- по убыванию, relevance -- сначала наиболее релевантные. Для одинаковых значений товары упорядочиваются по продавцу
+-- и идентификатору, чтобы страницы результатов не пересекались
+CREATE
+OR REPLACE FUNCTION offers.offers_order(_sort VARCHAR) RETURNS TEXT AS
+$$
+DECLARE
+_direction TEXT := CASE WHEN _sort LIKE '-%' THEN ' DESC' ELSE '' END;
+BEGIN
+RETURN CASE ltrim(_sort, '-')
+           WHEN 'price' THEN 'price_rub' || _direction || ' NULLS LAST, '
+           WHEN 'quantity' THEN 'quantity' || _direction || ', '
+           WHEN 'seller' THEN 'seller_name' || _direction || ', '
+           WHEN 'relevance' THEN 'relevance DESC NULLS LAST, '
+           ELSE ''
+           END
+    || 'offer_name' || CASE WHEN ltrim(_sort, '-') = 'name' THEN _direction ELSE '' END
+    || ', seller_id, offer_id';
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
+-- Источник товаров для поиска. Действующая цена (P) и курс валюты (R) присоединяются, только если
+-- по цене в рублях выполняется отбор или сортировка, иначе запрос может использовать индексы Offer
+CREATE
+OR REPLACE FUNCTION offers.offers_source(_price BOOL) RETURNS TEXT AS
+$$
+BEGIN
+RETURN 'offers.Offer AS O'
+    || CASE WHEN _price THEN '
+    LEFT JOIN offers.ExchangeRate AS R ON R.currency = O.currency
+    CROSS JOIN LATERAL offers.effective_price(O.price, O.old_price, O.discount_from, O.discount_to) AS P'
+            ELSE '' END;
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
 CREATE
 OR REPLACE FUNCTION offers.get_offers(_seller_id INT DEFAULT NULL, _offer_id INT DEFAULT NULL,
                                   _offer_name VARCHAR DEFAULT NULL,
-                                  _ignore_register BOOL DEFAULT FALSE) RETURNS SETOF offers.OutputOffer AS
+                                  _ignore_register BOOL DEFAULT FALSE,
+                                  _category_id INT DEFAULT NULL,
+                                  _attributes JSONB DEFAULT NULL,
+                                  _seller_ids INT[] DEFAULT NULL,
+                                  _min_price NUMERIC DEFAULT NULL,
+                                  _max_price NUMERIC DEFAULT NULL,
+                                  _min_quantity INT DEFAULT NULL,
+                                  _in_stock_only BOOL DEFAULT FALSE,
+                                  _match VARCHAR DEFAULT 'substring',
+                                  _product_id INT DEFAULT NULL,
+                                  _sort VARCHAR DEFAULT 'name',
+                                  _limit INT DEFAULT NULL,
+                                  _offset INT DEFAULT 0) RETURNS SETOF offers.OutputOffer
+-- порог сходства для нечеткого поиска, значение по умолчанию (0.6) не допускает опечаток в коротких словах
+SET pg_trgm.word_similarity_threshold = 0.4 AS
 $$
+DECLARE
+_price BOOL := _min_price IS NOT NULL OR _max_price IS NOT NULL OR ltrim(_sort, '-') = 'price';
+_by_seller BOOL := ltrim(_sort, '-') = 'seller';
+_price_rub TEXT := 'CASE WHEN O.currency = ''RUB'' THEN P.price ELSE ROUND(P.price * R.rate, 2) END';
 BEGIN
+-- страница отбирается до вычисления цены, изображений и выделения слов, чтобы они вычислялись
+-- только для выводимых товаров
 RETURN QUERY EXECUTE '
-SELECT offer_id,
-       offer_name,
-       price,
-       quantity,
+SELECT O.offer_id,
+       O.offer_name,
+       P.price,
+       O.quantity,
+       O.currency,
+       ' || _price_rub || ' AS price_rub,
+       CASE WHEN P.discount THEN O.old_price END,
+       CASE WHEN P.discount THEN O.discount_to END,
+       O.category_id,
+       O.attributes,
+       ARRAY(SELECT url
+             FROM offers.OfferPicture AS OP
+             WHERE OP.seller_id = O.seller_id
+               AND OP.offer_id = O.offer_id
+               AND NOT OP.broken
+             ORDER BY position),
+       ' || offers.offers_highlight(_offer_name, _match) || ',
+       O.relevance,
        S.seller_id,
-       seller_name
-FROM offers.Seller AS S
-    JOIN offers.Offer AS O On S.seller_id = O.seller_id'
-                    || CASE WHEN _seller_id IS NOT NULL THEN ' AND S.seller_id = ' || _seller_id ELSE '' END
-                    || CASE WHEN _offer_id IS NOT NULL THEN ' AND offer_id = ' || _offer_id ELSE '' END
-        || CASE
-               WHEN _offer_name IS NOT NULL THEN ' AND offer_name'  || CASE WHEN _ignore_register = TRUE THEN ' ILIKE ' ELSE ' LIKE '
-END || quote_literal('%' || _offer_name || '%')
-               ELSE ''
-|| 'ORDER BY offer_name'
+       S.seller_name
+FROM (SELECT O.offer_id, O.offer_name, O.price, O.quantity, O.currency, O.old_price, O.discount_from,
+             O.discount_to, O.category_id, O.attributes, O.seller_id,
+             ' || offers.offers_relevance(_offer_name, _match) || ' AS relevance'
+    || CASE WHEN _price THEN ', ' || _price_rub || ' AS price_rub' ELSE '' END
+    || CASE WHEN _by_seller THEN ', S.seller_name' ELSE '' END || '
+      FROM ' || offers.offers_source(_price)
+    || CASE WHEN _by_seller THEN ' JOIN offers.Seller AS S ON S.seller_id = O.seller_id' ELSE '' END || '
+      WHERE ' || offers.offers_filter(_seller_id, _offer_id, _offer_name, _ignore_register, _category_id, _attributes,
+                                  _seller_ids, _min_price, _max_price, _min_quantity, _in_stock_only,
+                                  _match, _product_id) || '
+      ORDER BY ' || offers.offers_order(_sort) || '
+      LIMIT $1 OFFSET $2) AS O
+    LEFT JOIN offers.ExchangeRate AS R ON R.currency = O.currency
+    CROSS JOIN LATERAL offers.effective_price(O.price, O.old_price, O.discount_from, O.discount_to) AS P
+    JOIN offers.Seller AS S ON S.seller_id = O.seller_id
+ORDER BY ' || offers.offers_order(_sort)
+USING _limit, COALESCE(_offset, 0);
 END;
+$$
+LANGUAGE plpgsql;
+
+-- Количество товаров, удовлетворяющих условиям поиска, но не больше _max_count (NULL -- без ограничения)
+CREATE
+OR REPLACE FUNCTION offers.count_offers(_seller_id INT DEFAULT NULL, _offer_id INT DEFAULT NULL,
+                                    _offer_name VARCHAR DEFAULT NULL,
+                                    _ignore_register BOOL DEFAULT FALSE,
+                                    _category_id INT DEFAULT NULL,
+                                    _attributes JSONB DEFAULT NULL,
+                                    _seller_ids INT[] DEFAULT NULL,
+                                    _min_price NUMERIC DEFAULT NULL,
+                                    _max_price NUMERIC DEFAULT NULL,
+                                    _min_quantity INT DEFAULT NULL,
+                                    _in_stock_only BOOL DEFAULT FALSE,
+                                    _match VARCHAR DEFAULT 'substring',
+                                    _product_id INT DEFAULT NULL,
+                                    _max_count BIGINT DEFAULT NULL) RETURNS BIGINT
+SET pg_trgm.word_similarity_threshold = 0.4 AS
+$$
+DECLARE
+_total BIGINT;
+BEGIN
+EXECUTE '
+SELECT COUNT(*)
+FROM (SELECT
+      FROM ' || offers.offers_source(_min_price IS NOT NULL OR _max_price IS NOT NULL) || '
+      WHERE ' || offers.offers_filter(_seller_id, _offer_id, _offer_name, _ignore_register, _category_id, _attributes,
+                                  _seller_ids, _min_price, _max_price, _min_quantity, _in_stock_only,
+                                  _match, _product_id) || '
+      LIMIT $1) AS C'
+INTO _total
+USING _max_count;
+RETURN _total;
 END;
 $$
 LANGUAGE plpgsql;
 
-CREATE OR REPLACE FUNCTION offers.insert_task(_seller_id INT) RETURNS INT AS
+-- Агрегаты (фасеты) по товарам, удовлетворяющим условиям поиска. _facets -- вычисляемые фасеты:
+-- sellers (количество товаров продавцов), price (гистограмма цены в рублях), categories (количество
+-- товаров категорий) и attributes (количество товаров по значениям атрибутов). Фасеты без данных не выводятся
+CREATE
+OR REPLACE FUNCTION offers.offer_facets(_facets VARCHAR[],
+                                    _seller_id INT DEFAULT NULL, _offer_id INT DEFAULT NULL,
+                                    _offer_name VARCHAR DEFAULT NULL,
+                                    _ignore_register BOOL DEFAULT FALSE,
+                                    _category_id INT DEFAULT NULL,
+                                    _attributes JSONB DEFAULT NULL,
+                                    _seller_ids INT[] DEFAULT NULL,
+                                    _min_price NUMERIC DEFAULT NULL,
+                                    _max_price NUMERIC DEFAULT NULL,
+                                    _min_quantity INT DEFAULT NULL,
+                                    _in_stock_only BOOL DEFAULT FALSE,
+                                    _match VARCHAR DEFAULT 'substring',
+                                    _product_id INT DEFAULT NULL) RETURNS JSONB
+SET pg_trgm.word_similarity_threshold = 0.4 AS
+$$
+DECLARE
+_result JSONB;
+BEGIN
+EXECUTE '
+WITH F AS (SELECT O.seller_id,
+                  CASE WHEN O.currency = ''RUB'' THEN P.price ELSE ROUND(P.price * R.rate, 2) END AS price_rub,
+                  O.category_id,
+                  O.attributes
+           FROM offers.Offer AS O
+               LEFT JOIN offers.ExchangeRate AS R ON R.currency = O.currency
+               CROSS JOIN LATERAL offers.effective_price(O.price, O.old_price, O.discount_from, O.discount_to) AS P
+           WHERE ' || offers.offers_filter(_seller_id, _offer_id, _offer_name, _ignore_register, _category_id, _attributes,
+                                        _seller_ids, _min_price, _max_price, _min_quantity, _in_stock_only,
+                                        _match, _product_id) || '),
+     -- шаг гистограммы цены: 1, 2 или 5, умноженные на степень 10, примерно 10 интервалов
+     B AS (SELECT CASE WHEN X.raw <= 0 THEN 1
+                       WHEN X.raw / X.magnitude <= 1 THEN X.magnitude
+                       WHEN X.raw / X.magnitude <= 2 THEN 2 * X.magnitude
+                       WHEN X.raw / X.magnitude <= 5 THEN 5 * X.magnitude
+                       ELSE 10 * X.magnitude END AS step
+           FROM (SELECT R.raw, CASE WHEN R.raw > 0 THEN power(10, floor(log(R.raw))) END AS magnitude
+                 FROM (SELECT (MAX(price_rub) - MIN(price_rub)) / 10 AS raw
+                       FROM F
+                       WHERE $1 @> ARRAY[''price'']::VARCHAR[]) AS R) AS X)
+SELECT jsonb_strip_nulls(jsonb_build_object(
+    ''sellers'', (SELECT jsonb_agg(jsonb_build_object(''seller_id'', G.seller_id, ''seller_name'', S.seller_name,
+                                                      ''count'', G.count) ORDER BY G.count DESC, S.seller_name)
+                  FROM (SELECT seller_id, COUNT(*) AS count
+                        FROM F
+                        WHERE $1 @> ARRAY[''sellers'']::VARCHAR[]
+                        GROUP BY seller_id
+                        ORDER BY COUNT(*) DESC
+                        LIMIT 100) AS G
+                      JOIN offers.Seller AS S ON S.seller_id = G.seller_id),
+    ''price'', (SELECT jsonb_agg(jsonb_build_object(''from'', G.bucket, ''to'', G.bucket + B.step,
+                                                    ''count'', G.count) ORDER BY G.bucket)
+                FROM B
+                    CROSS JOIN LATERAL (SELECT floor(F.price_rub / B.step) * B.step AS bucket, COUNT(*) AS count
+                                        FROM F
+                                        WHERE F.price_rub IS NOT NULL
+                                        GROUP BY 1) AS G
+                WHERE B.step IS NOT NULL),
+    ''categories'', (SELECT jsonb_agg(jsonb_build_object(''category_id'', G.category_id,
+                                                         ''category_name'', C.category_name,
+                                                         ''count'', G.count) ORDER BY G.count DESC, C.category_name)
+                     FROM (SELECT category_id, COUNT(*) AS count
+                           FROM F
+                           WHERE category_id IS NOT NULL
+                             AND $1 @> ARRAY[''categories'']::VARCHAR[]
+                           GROUP BY category_id) AS G
+                         JOIN offers.Category AS C ON C.category_id = G.category_id),
+    ''attributes'', (SELECT jsonb_object_agg(A.name, A.value_counts)
+                     FROM (SELECT V.name,
+                                  jsonb_agg(jsonb_build_object(''value'', V.value, ''count'', V.count)
+                                            ORDER BY V.count DESC, V.value) AS value_counts
+                           FROM (SELECT E.key AS name, E.value, COUNT(*) AS count,
+                                        ROW_NUMBER() OVER (PARTITION BY E.key ORDER BY COUNT(*) DESC, E.value) AS rank
+                                 FROM F
+                                     CROSS JOIN LATERAL jsonb_each(F.attributes) AS E
+                                 WHERE $1 @> ARRAY[''attributes'']::VARCHAR[]
+                                 GROUP BY E.key, E.value) AS V
+                           -- не более 20 самых частых значений каждого атрибута
+                           WHERE V.rank <= 20
+                           GROUP BY V.name) AS A)))'
+INTO _result
+USING _facets;
+RETURN _result;
+END;
+$$
+LANGUAGE plpgsql;
+
+-- Нормализованное название товара для сопоставления предложений: нижний регистр, ё заменяется на е,
+-- знаки препинания и повторяющиеся пробелы удаляются
+CREATE
+OR REPLACE FUNCTION offers.product_name_key(_offer_name VARCHAR) RETURNS VARCHAR AS
+$$
+SELECT trim(regexp_replace(replace(LOWER(_offer_name), 'ё', 'е'), '[^[:alnum:]]+', ' ', 'g'))::VARCHAR(255);
+$$
+LANGUAGE sql IMMUTABLE;
+
+-- Сопоставить с товарами очередные _batch предложений без товара. Предложение со штрихкодом относится
+-- к товару с тем же штрихкодом, без штрихкода -- к товару с наиболее похожим названием. Если подходящего
+-- товара нет, создается новый. Вернет количество сопоставленных предложений
+CREATE
+OR REPLACE FUNCTION offers.match_offers(_batch INT DEFAULT 1000) RETURNS INT
+-- минимальное сходство (similarity) названий предложений одного товара
+SET pg_trgm.similarity_threshold = 0.6 AS
+$$
+DECLARE
+_offer RECORD;
+_barcode VARCHAR;
+_name_key VARCHAR;
+_product_id INT;
+_matched INT := 0;
+BEGIN
+FOR _offer IN
+SELECT O.seller_id, O.offer_id, O.offer_name, O.attributes
+FROM offers.Offer AS O
+WHERE O.product_id IS NULL
+LIMIT _batch
+    FOR UPDATE SKIP LOCKED
+    LOOP
+        _barcode := NULLIF(trim(_offer.attributes ->> 'barcode'), '');
+        _name_key := offers.product_name_key(_offer.offer_name);
+        _product_id := NULL;
+        IF _barcode IS NOT NULL THEN
+            SELECT P.product_id INTO _product_id FROM offers.Product AS P WHERE P.barcode = _barcode;
+            IF _product_id IS NULL THEN
+                INSERT INTO offers.Product(product_name, barcode, name_key)
+                VALUES (_offer.offer_name, _barcode, _name_key)
+                ON CONFLICT (barcode) DO UPDATE SET barcode = EXCLUDED.barcode
+                RETURNING product_id INTO _product_id;
+            END IF;
+        ELSE
+            SELECT P.product_id
+            INTO _product_id
+            FROM offers.Product AS P
+            WHERE P.name_key % _name_key
+            ORDER BY similarity(P.name_key, _name_key) DESC, P.product_id
+            LIMIT 1;
+            IF _product_id IS NULL THEN
+                INSERT INTO offers.Product(product_name, name_key)
+                VALUES (_offer.offer_name, _name_key)
+                RETURNING product_id INTO _product_id;
+            END IF;
+        END IF;
+        UPDATE offers.Offer
+        SET product_id = _product_id
+        WHERE seller_id = _offer.seller_id
+          AND offer_id = _offer.offer_id;
+        _matched := _matched + 1;
+    END LOOP;
+RETURN _matched;
+END;
+$$
+LANGUAGE plpgsql;
+
+-- Подсказки для строки поиска: различные (без учета регистра) названия товаров, начинающиеся с _query,
+-- и количество товаров с таким названием. Для ограничения времени ответа рассматриваются только первые
+-- _scan_limit подходящих товаров в порядке названия
+CREATE
+OR REPLACE FUNCTION offers.suggest_offers(_query VARCHAR, _seller_id INT DEFAULT NULL, _limit INT DEFAULT 10,
+                                      _scan_limit INT DEFAULT 5000)
+    RETURNS TABLE (offer_name VARCHAR, offers_count BIGINT) AS
+$$
+BEGIN
+-- шаблон подставляется в текст запроса, чтобы планировщик использовал индекс по началу названия
+RETURN QUERY EXECUTE '
+SELECT MIN(T.offer_name)::VARCHAR, COUNT(*)
+FROM (SELECT O.offer_name, LOWER(O.offer_name) COLLATE "C" AS name_lower
+      FROM offers.Offer AS O
+      WHERE LOWER(O.offer_name) COLLATE "C" LIKE '
+    || quote_literal(replace(replace(replace(LOWER(_query), '\', '\\'), '%', '\%'), '_', '\_') || '%')
+    || CASE WHEN _seller_id IS NOT NULL THEN ' AND O.seller_id = ' || _seller_id ELSE '' END || '
+      ORDER BY LOWER(O.offer_name) COLLATE "C"
+      LIMIT $1) AS T
+GROUP BY T.name_lower
+ORDER BY COUNT(*) DESC, T.name_lower
+LIMIT $2'
+USING _scan_limit, _limit;
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION offers.insert_task(_seller_id INT, _status VARCHAR(30) DEFAULT 'Выполняется',
+                                             _source_url VARCHAR(2048) DEFAULT NULL,
+                                             _file_size INT DEFAULT NULL,
+                                             _file_hash CHAR(64) DEFAULT NULL,
+                                             _sheet VARCHAR(255) DEFAULT NULL) RETURNS INT AS
     $$
 BEGIN
-INSERT INTO offers.Task(seller_id)
-VALUES (_seller_id);
+INSERT INTO offers.Task(seller_id, status, source_url, file_size, file_hash, sheet)
+VALUES (_seller_id, _status, _source_url, _file_size, _file_hash, _sheet);
 RETURN currval('offers.task_task_id_seq');
 END;
     $$
 LANGUAGE plpgsql;
 
 CREATE
-OR REPLACE FUNCTION offers.load_offers(errors INT, _task_id INT, json_data json) RETURNS VOID AS
+OR REPLACE FUNCTION offers.last_applied_hash(_seller_id INT, _sheet VARCHAR(255) DEFAULT NULL) RETURNS CHAR(64) AS
+$$
+BEGIN
+-- если последний файл загружался с другим выбором листа, он считается измененным
+RETURN (SELECT CASE WHEN sheet IS NOT DISTINCT FROM _sheet THEN file_hash END
+        FROM offers.Task
+        WHERE seller_id = _seller_id
+          AND status = 'Завершен'
+        ORDER BY finish_date DESC, task_id DESC
+        LIMIT 1);
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE
+OR REPLACE FUNCTION offers.load_offers(json_data json, OUT num_created INT, OUT num_updated INT,
+                                       OUT num_deleted INT, OUT num_errors INT) AS
 $$
 BEGIN
 WITH from_json AS (
-    SELECT T.offer_id, T.seller_id, T.offer_name, T.price, T.quantity, T.available
+    SELECT T.offer_id, T.seller_id, T.offer_name, T.price, T.quantity, T.available, T.currency,
+           T.old_price, T.discount_from, T.discount_to, T.category_id, T.attributes, T.pictures
     FROM json_populate_recordset(NULL::offers.ExcelOffer, json_data) AS T
+    WHERE T.category_id IS NULL
+       OR EXISTS(SELECT * FROM offers.Category AS C WHERE C.category_id = T.category_id)
 ),
      insert_buffer AS (
 INSERT
-INTO offers.Offer (offer_id, offer_name, price, quantity, seller_id)
+INTO offers.Offer (offer_id, offer_name, price, quantity, currency, old_price, discount_from, discount_to, category_id,
+                   attributes, seller_id)
 SELECT offer_id,
        offer_name,
        price,
        quantity,
+       currency,
+       old_price,
+       discount_from,
+       discount_to,
+       category_id,
+       attributes,
        seller_id
 FROM from_json AS T
 WHERE available = true
@@ -136,6 +693,8 @@ WHERE available = true
                  FROM offers.Offer AS O
                  WHERE T.seller_id = o.seller_id
                    AND T.offer_id = O.offer_id)
+-- товар, созданный параллельной транзакцией, не вставляется повторно (num_created не учитывает его)
+ON CONFLICT DO NOTHING
     RETURNING 1 AS inserted
          ),
          error_buffer AS (
@@ -152,7 +711,17 @@ UPDATE offers.Offer
 SET
     offer_name = T.offer_name,
     price = T.price,
-    quantity = T.quantity
+    quantity = T.quantity,
+    currency = T.currency,
+    old_price = T.old_price,
+    discount_from = T.discount_from,
+    discount_to = T.discount_to,
+    category_id = T.category_id,
+    attributes = T.attributes,
+    -- при изменении названия или штрихкода предложение сопоставляется с товаром заново
+    product_id = CASE WHEN offers.Offer.offer_name = T.offer_name
+                           AND offers.Offer.attributes ->> 'barcode' IS NOT DISTINCT FROM T.attributes ->> 'barcode'
+                      THEN offers.Offer.product_id END
 FROM from_json AS T
 WHERE available = true
   AND T.seller_id = offers.Offer.seller_id
@@ -169,14 +738,161 @@ WHERE EXISTS (SELECT *
   AND T.offer_id = O.offer_id)
     RETURNING 1 AS deleted
     )
+SELECT (SELECT COUNT(*) FROM insert_buffer),
+       (SELECT COUNT(*) FROM update_buffer),
+       (SELECT COUNT(*) FROM delete_buffer),
+       (SELECT COUNT(*) FROM error_buffer)
+INTO num_created, num_updated, num_deleted, num_errors;
+-- строки с несуществующей категорией считаются ошибочными
+num_errors := num_errors + (SELECT COUNT(*)
+                            FROM json_populate_recordset(NULL::offers.ExcelOffer, json_data) AS T
+                            WHERE T.category_id IS NOT NULL
+                              AND NOT EXISTS(SELECT * FROM offers.Category AS C WHERE C.category_id = T.category_id));
+
+-- изображения загруженных товаров, pictures равный NULL -- изображения не изменяются
+DELETE
+FROM offers.OfferPicture AS P
+    USING json_populate_recordset(NULL::offers.ExcelOffer, json_data) AS T
+WHERE T.available = true
+  AND P.seller_id = T.seller_id
+  AND P.offer_id = T.offer_id
+  AND P.position > cardinality(T.pictures);
+INSERT INTO offers.OfferPicture (seller_id, offer_id, position, url)
+SELECT T.seller_id, T.offer_id, U.position, U.url
+FROM json_populate_recordset(NULL::offers.ExcelOffer, json_data) AS T
+    CROSS JOIN LATERAL unnest(T.pictures) WITH ORDINALITY AS U(url, position)
+WHERE T.available = true
+  AND (T.category_id IS NULL OR EXISTS(SELECT * FROM offers.Category AS C WHERE C.category_id = T.category_id))
+ON CONFLICT (seller_id, offer_id, position) DO UPDATE
+SET url = EXCLUDED.url, broken = FALSE, checked_at = NULL
+WHERE offers.OfferPicture.url <> EXCLUDED.url;
+END;
+$$
+LANGUAGE plpgsql;
+
+-- Слияние временной таблицы задачи, заполненной через COPY, с offers.Offer.
+-- Правила те же, что и в load_offers
+CREATE
+OR REPLACE FUNCTION offers.merge_staging_offers(_staging VARCHAR(63), OUT num_created INT, OUT num_updated INT,
+                                                OUT num_deleted INT, OUT num_errors INT) AS
+$$
+DECLARE
+_category_errors INT;
+BEGIN
+-- строки с несуществующей категорией считаются ошибочными
+EXECUTE format('DELETE FROM %1$I AS T WHERE category_id IS NOT NULL
+                AND NOT EXISTS(SELECT * FROM offers.Category AS C WHERE C.category_id = T.category_id)', _staging);
+GET DIAGNOSTICS _category_errors = ROW_COUNT;
+EXECUTE format('ANALYZE %I', _staging);
+EXECUTE format($merge$
+WITH insert_buffer AS (
+INSERT
+INTO offers.Offer (offer_id, offer_name, price, quantity, currency, old_price, discount_from, discount_to, category_id,
+                   attributes, seller_id)
+SELECT offer_id,
+       offer_name,
+       price,
+       quantity,
+       currency,
+       old_price,
+       discount_from,
+       discount_to,
+       category_id,
+       attributes,
+       seller_id
+FROM %1$I AS T
+WHERE available = true
+  AND NOT EXISTS(SELECT *
+                 FROM offers.Offer AS O
+                 WHERE T.seller_id = O.seller_id
+                   AND T.offer_id = O.offer_id)
+    RETURNING 1 AS inserted
+         ),
+         error_buffer AS (
+SELECT 1 AS errors
+FROM %1$I AS T
+WHERE available = false
+  AND NOT EXISTS (SELECT *
+    FROM offers.Offer AS O
+    WHERE T.seller_id = O.seller_id
+  AND T.offer_id = O.offer_id)
+    )
+    , update_buffer AS (
+UPDATE offers.Offer
+SET
+    offer_name = T.offer_name,
+    price = T.price,
+    quantity = T.quantity,
+    currency = T.currency,
+    old_price = T.old_price,
+    discount_from = T.discount_from,
+    discount_to = T.discount_to,
+    category_id = T.category_id,
+    attributes = T.attributes,
+    -- при изменении названия или штрихкода предложение сопоставляется с товаром заново
+    product_id = CASE WHEN offers.Offer.offer_name = T.offer_name
+                           AND offers.Offer.attributes ->> 'barcode' IS NOT DISTINCT FROM T.attributes ->> 'barcode'
+                      THEN offers.Offer.product_id END
+FROM %1$I AS T
+WHERE available = true
+  AND T.seller_id = offers.Offer.seller_id
+  AND T.offer_id = offers.Offer.offer_id
+    RETURNING 1 AS updated
+    )
+    , delete_buffer AS (
+DELETE
+FROM offers.Offer AS O
+WHERE EXISTS (SELECT *
+    FROM %1$I AS T
+    WHERE available = false
+  AND T.seller_id = O.seller_id
+  AND T.offer_id = O.offer_id)
+    RETURNING 1 AS deleted
+    )
+SELECT (SELECT COUNT(*) FROM insert_buffer),
+       (SELECT COUNT(*) FROM update_buffer),
+       (SELECT COUNT(*) FROM delete_buffer),
+       (SELECT COUNT(*) FROM error_buffer)
+$merge$, _staging)
+INTO num_created, num_updated, num_deleted, num_errors;
+num_errors := num_errors + _category_errors;
+
+-- изображения загруженных товаров, pictures равный NULL -- изображения не изменяются
+EXECUTE format($pictures$
+DELETE
+FROM offers.OfferPicture AS P
+    USING %1$I AS T
+WHERE T.available = true
+  AND P.seller_id = T.seller_id
+  AND P.offer_id = T.offer_id
+  AND P.position > cardinality(T.pictures)
+$pictures$, _staging);
+EXECUTE format($pictures$
+INSERT INTO offers.OfferPicture (seller_id, offer_id, position, url)
+SELECT T.seller_id, T.offer_id, U.position, U.url
+FROM %1$I AS T
+    CROSS JOIN LATERAL unnest(T.pictures) WITH ORDINALITY AS U(url, position)
+WHERE T.available = true
+ON CONFLICT (seller_id, offer_id, position) DO UPDATE
+SET url = EXCLUDED.url, broken = FALSE, checked_at = NULL
+WHERE offers.OfferPicture.url <> EXCLUDED.url
+$pictures$, _staging);
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE
+OR REPLACE FUNCTION offers.finish_task(_task_id INT, _errors INT, _created INT, _updated INT, _deleted INT) RETURNS VOID AS
+$$
+BEGIN
 UPDATE offers.Task
-SET num_created = (SELECT COUNT(*) FROM insert_buffer),
-    num_errors  = (SELECT COUNT(*) FROM error_buffer) + errors,
-    num_updated = (SELECT COUNT(*) FROM update_buffer),
-    num_deleted = (SELECT COUNT(*) FROM delete_buffer),
+SET num_created = _created,
+    num_errors  = _errors,
+    num_updated = _updated,
+    num_deleted = _deleted,
     finish_date = CURRENT_TIMESTAMP,
     status      = 'Завершен'
-WHERE offers.Task.task_id = _task_id;
+WHERE task_id = _task_id;
 END;
 $$
 LANGUAGE plpgsql;
@@ -195,7 +911,10 @@ RETURN QUERY(
                     num_deleted,
                     S.seller_id,
                     S.seller_name,
-                    S.created_at FROM offers.Seller AS S
+                    S.created_at,
+                    source_url,
+                    file_size,
+                    error_message FROM offers.Seller AS S
                  JOIN offers.Task AS T ON S.seller_id = T.seller_id
         ORDER BY CASE WHEN finish_date IS NULL THEN 0 ELSE 1 END,
                     start_date DESC
@@ -219,10 +938,170 @@ RETURN QUERY(
                     num_deleted,
                     S.seller_id,
                     S.seller_name,
-                    S.created_at FROM offers.Seller AS S
+                    S.created_at,
+                    source_url,
+                    file_size,
+                    error_message FROM offers.Seller AS S
                  JOIN offers.Task AS T ON S.seller_id = T.seller_id
         WHERE task_id = _task_id
     );
 END;
 $$
-LANGUAGE plpgsql;
\ No newline at end of file
+LANGUAGE plpgsql;
+
+CREATE TABLE offers.Feed
+(
+    seller_id     INT PRIMARY KEY REFERENCES offers.Seller (seller_id),
+    feed_url      VARCHAR(2048) NOT NULL,
+    schedule      VARCHAR(100)  NOT NULL,
+    etag          VARCHAR(255) NULL,
+    last_modified VARCHAR(255) NULL,
+    content_hash  CHAR(64) NULL,
+    last_checked  TIMESTAMP NULL,
+    last_task_id  INT NULL REFERENCES offers.Task (task_id),
+    last_error    VARCHAR(1024) NULL
+);
+
+CREATE
+OR REPLACE FUNCTION offers.set_feed(_seller_id INT, _feed_url VARCHAR(2048), _schedule VARCHAR(100)) RETURNS VOID AS
+$$
+BEGIN
+INSERT INTO offers.Feed(seller_id, feed_url, schedule)
+VALUES (_seller_id, _feed_url, _schedule)
+ON CONFLICT (seller_id) DO UPDATE
+SET feed_url      = EXCLUDED.feed_url,
+    schedule      = EXCLUDED.schedule,
+    etag          = CASE WHEN offers.Feed.feed_url = EXCLUDED.feed_url THEN offers.Feed.etag END,
+    last_modified = CASE WHEN offers.Feed.feed_url = EXCLUDED.feed_url THEN offers.Feed.last_modified END,
+    content_hash  = CASE WHEN offers.Feed.feed_url = EXCLUDED.feed_url THEN offers.Feed.content_hash END;
+END;
+$$
+LANGUAGE plpgsql;
+
+
+CREATE TABLE offers.IdempotencyKey
+(
+    scope           VARCHAR(50)  NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    result_id       INT NULL,
+    -- sha256 хеш данных запроса: повторный запрос с тем же ключом должен совпадать с исходным
+    request_hash    CHAR(64)     NULL,
+    created_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT PK_IdempotencyKey PRIMARY KEY (scope, idempotency_key)
+);
+
+CREATE INDEX IX_IdempotencyKey_CreatedAt ON offers.IdempotencyKey (created_at);
+
+CREATE
+OR REPLACE FUNCTION offers.reserve_idempotency_key(_scope VARCHAR(50), _key VARCHAR(255), _window_seconds INT,
+                                                   _request_hash CHAR(64), _pending_seconds INT,
+                                                   OUT is_new BOOL, OUT original_id INT, OUT same_request BOOL) AS
+$$
+BEGIN
+-- резерв без результата старше _pending_seconds остался от прерванного запроса и освобождается
+DELETE
+FROM offers.IdempotencyKey
+WHERE created_at < CURRENT_TIMESTAMP - _window_seconds * INTERVAL '1 second'
+   OR (result_id IS NULL AND created_at < CURRENT_TIMESTAMP - _pending_seconds * INTERVAL '1 second');
+
+INSERT INTO offers.IdempotencyKey(scope, idempotency_key, request_hash)
+VALUES (_scope, _key, _request_hash)
+ON CONFLICT DO NOTHING;
+is_new := FOUND;
+same_request := TRUE;
+
+IF NOT is_new THEN
+SELECT K.result_id, K.request_hash IS NOT DISTINCT FROM _request_hash
+INTO original_id, same_request
+FROM offers.IdempotencyKey AS K
+WHERE K.scope = _scope
+  AND K.idempotency_key = _key;
+END IF;
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE TABLE offers.SellerSettings
+(
+    seller_id        INT PRIMARY KEY REFERENCES offers.Seller (seller_id),
+    max_upload_bytes BIGINT NULL CHECK ( max_upload_bytes > 0 ),
+    max_rows         INT NULL CHECK ( max_rows > 0 ),
+    sheet            VARCHAR(255) NULL,
+    currency         CHAR(3) NULL,
+    attributes       JSONB NULL,
+    picture_column   INT NULL
+);
+
+CREATE
+OR REPLACE FUNCTION offers.set_seller_settings(_seller_id INT, _max_upload_bytes BIGINT, _max_rows INT,
+                                               _sheet VARCHAR(255) DEFAULT NULL,
+                                               _currency CHAR(3) DEFAULT NULL,
+                                               _attributes JSONB DEFAULT NULL,
+                                               _picture_column INT DEFAULT NULL) RETURNS VOID AS
+$$
+DECLARE
+    _old offers.SellerSettings;
+BEGIN
+-- после изменения настроек обработки строк тот же файл загружается заново, а не пропускается как неизмененный
+SELECT * INTO _old FROM offers.SellerSettings WHERE seller_id = _seller_id;
+IF _old.currency IS DISTINCT FROM _currency OR _old.attributes IS DISTINCT FROM _attributes
+    OR _old.picture_column IS DISTINCT FROM _picture_column THEN
+    UPDATE offers.Task SET file_hash = NULL WHERE seller_id = _seller_id AND file_hash IS NOT NULL;
+END IF;
+
+INSERT INTO offers.SellerSettings(seller_id, max_upload_bytes, max_rows, sheet, currency, attributes, picture_column)
+VALUES (_seller_id, _max_upload_bytes, _max_rows, _sheet, _currency, _attributes, _picture_column)
+ON CONFLICT (seller_id) DO UPDATE
+SET max_upload_bytes = EXCLUDED.max_upload_bytes,
+    max_rows         = EXCLUDED.max_rows,
+    sheet            = EXCLUDED.sheet,
+    currency         = EXCLUDED.currency,
+    attributes       = EXCLUDED.attributes,
+    picture_column   = EXCLUDED.picture_column;
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE TABLE offers.TaskFile
+(
+    task_id       INT REFERENCES offers.Task (task_id),
+    file_index    INT           NOT NULL,
+    file_name     VARCHAR(1024) NOT NULL,
+    num_errors    INT NULL,
+    num_created   INT NULL,
+    num_updated   INT NULL,
+    num_deleted   INT NULL,
+    error_message VARCHAR(1024) NULL,
+    sheets_read    TEXT[] NULL,
+    sheets_skipped TEXT[] NULL,
+    CONSTRAINT PK_TaskFile PRIMARY KEY (task_id, file_index)
+);
+
+CREATE
+OR REPLACE FUNCTION offers.insert_task_file(_task_id INT, _file_index INT, _file_name VARCHAR(1024), _num_errors INT,
+                                            _num_created INT, _num_updated INT, _num_deleted INT,
+                                            _error_message VARCHAR(1024), _sheets_read TEXT[] DEFAULT NULL,
+                                            _sheets_skipped TEXT[] DEFAULT NULL) RETURNS VOID AS
+$$
+BEGIN
+INSERT INTO offers.TaskFile(task_id, file_index, file_name, num_errors, num_created, num_updated, num_deleted,
+                            error_message, sheets_read, sheets_skipped)
+VALUES (_task_id, _file_index, _file_name, _num_errors, _num_created, _num_updated, _num_deleted,
+        _error_message, _sheets_read, _sheets_skipped);
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE
+OR REPLACE FUNCTION offers.get_task_files(_task_id INT) RETURNS SETOF offers.TaskFile AS
+$$
+BEGIN
+RETURN QUERY(
+    SELECT *
+    FROM offers.TaskFile
+    WHERE task_id = _task_id
+    ORDER BY file_index
+    );
+END;
+$$
+LANGUAGE plpgsql;
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var downloadClient = &http.Client{Timeout: 60 * time.Second, Transport: fetchTransport}
+
+var errFileTooLarge = errors.New("размер файла превышает допустимый")
+var errForbiddenAddress = errors.New("запросы к внутренним адресам запрещены")
+
+// максимальный размер JSON запроса на загрузку по ссылке, до и после распаковки
+const maxUrlRequestBytes int64 = 64 << 10
+
+// Сети, не являющиеся публичными: loopback, частные сети, link-local (в том числе адрес
+// метаданных облака 169.254.169.254), служебные и групповые адреса
+var nonPublicNetworks = parseNetworks("0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12," +
+	"192.0.0.0/24,192.168.0.0/16,198.18.0.0/15,224.0.0.0/4,240.0.0.0/4,::/128,::1/128,64:ff9b::/96,fc00::/7,fe80::/10,ff00::/8")
+
+// сети, запросы к которым разрешены несмотря на то, что они не публичные (FETCH_ALLOWED_NETWORKS)
+var allowedFetchNetworks []*net.IPNet
+
+// Соединения для запросов по адресам, полученным от продавцов (файлы, фиды, изображения):
+// адрес проверяется после разрешения имени при каждом соединении, в том числе при перенаправлениях
+var fetchDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkFetchAddress}
+
+var fetchTransport = &http.Transport{
+	DialContext:           fetchDialer.DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// Разобрать список сетей в формате CIDR через запятую. nil -- список некорректен
+func parseNetworks(value string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверить адрес, с которым устанавливается соединение
+func checkFetchAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || inNetworks(ip, nonPublicNetworks) && !inNetworks(ip, allowedFetchNetworks) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+// Проверить, что строка -- http или https адрес
+func validHttpUrl(rawUrl string) bool {
+	parsedUrl, err := url.Parse(rawUrl)
+	return err == nil && (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != ""
+}
+
+// Скачать файл по url
+func downloadFile(client *http.Client, fileUrl string, limit int64) (*uploadedFile, error) {
+	response, err := client.Get(fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("сервер вернул статус %d", response.StatusCode)
+	}
+	return saveUpload(response.Body, path.Base(response.Request.URL.Path), limit)
+}
+
+// Скачать файл для задачи и запустить его обработку. При любой ошибке задача завершается
+// со статусом "Ошибка", чтобы не остаться в статусе "Скачивание" или "Выполняется"
+func downloadAndLoad(db *sql.DB, fileUrl string, sheet string, sellerId int, taskId int) {
+	fail := func(err error, message string) {
+		log.Println(err.Error())
+		if err = taskSetError(db, taskId, message); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	maxBytes, _, err := sellerLimits(db, sellerId)
+	if err != nil {
+		fail(err, "ошибка при скачивании файла")
+		return
+	}
+	file, err := downloadFile(downloadClient, fileUrl, maxBytes)
+	if err != nil {
+		if err = taskSetError(db, taskId, "ошибка при скачивании файла: "+err.Error()); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	query := "UPDATE offers.Task SET status = 'Выполняется', file_size = $2, file_hash = $3 WHERE task_id = $1;"
+	_, err = db.Exec(query, taskId, file.Size, file.Hash)
+	if err != nil {
+		file.Remove()
+		fail(err, "ошибка при сохранении товаров")
+		return
+	}
+	unchanged, err := fileUnchanged(db, sellerId, file.Hash, sheet)
+	if err != nil {
+		file.Remove()
+		fail(err, "ошибка при сохранении товаров")
+		return
+	}
+	if unchanged {
+		file.Remove()
+		if err = taskSetUnchanged(db, taskId); err != nil {
+			fail(err, "ошибка при сохранении товаров")
+		}
+		return
+	}
+	readExcelFile(db, file, sheet, sellerId, taskId)
+}
+
+func loadOffersFromUrl(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+
+	limited := &limitedBody{ReadCloser: r.Body, remaining: maxUrlRequestBytes}
+	r.Body = limited
+	decoded, err := decodeRequestBody(r)
+	if err != nil {
+		if limited.exceeded {
+			sendErrorMessage(w, requestTooLargeMessage(maxUrlRequestBytes), http.StatusRequestEntityTooLarge)
+		} else if err == errUnsupportedEncoding {
+			sendErrorMessage(w, err.Error(), http.StatusUnsupportedMediaType)
+		} else {
+			sendErrorMessage(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	// распакованный запрос ограничен тем же размером, что и сжатый
+	unpacked := &limitedBody{ReadCloser: decoded, remaining: maxUrlRequestBytes}
+	body, err := ioutil.ReadAll(unpacked)
+	if err != nil {
+		if limited.exceeded || unpacked.exceeded {
+			sendErrorMessage(w, requestTooLargeMessage(maxUrlRequestBytes), http.StatusRequestEntityTooLarge)
+		} else if decoded.failed {
+			sendErrorMessage(w, errInvalidEncoding.Error(), http.StatusBadRequest)
+		} else {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		}
+		return
+	}
+	keyVal := make(map[string]string)
+	err = json.Unmarshal(body, &keyVal)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return
+	}
+	fileUrl := keyVal["url"]
+	if !validHttpUrl(fileUrl) {
+		sendErrorMessage(w, "Неверный формат url! Ожидается http или https адрес", http.StatusBadRequest)
+		return
+	}
+
+	if !validSheet(keyVal["sheet"]) {
+		sendErrorMessage(w, "недопустимое значение sheet", http.StatusBadRequest)
+		return
+	}
+	sheet, err := sellerSheet(db, sellerId, keyVal["sheet"])
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	taskId, err := insertTask(db, sellerId, "Скачивание", &fileUrl, nil, nil, sheet)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	go downloadAndLoad(db, fileUrl, sheet, sellerId, taskId)
+
+	taskMessage := map[string]int{"task_id": taskId}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(taskMessage)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
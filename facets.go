@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// количество товаров продавца в результате поиска
+type SellerFacet struct {
+	SellerId   int    `json:"seller_id"`
+	SellerName string `json:"seller_name"`
+	Count      int    `json:"count"`
+}
+
+// интервал гистограммы цены в рублях [From, To)
+type PriceBucket struct {
+	From  Price `json:"from"`
+	To    Price `json:"to"`
+	Count int   `json:"count"`
+}
+
+// количество товаров категории в результате поиска
+type CategoryFacet struct {
+	CategoryId   int    `json:"category_id"`
+	CategoryName string `json:"category_name"`
+	Count        int    `json:"count"`
+}
+
+// количество товаров с заданным значением атрибута
+type AttributeFacet struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// Фасеты результата поиска, вычисляются offers.offer_facets. Фасеты без данных не выводятся
+type SearchFacets struct {
+	Sellers    []SellerFacet               `json:"sellers,omitempty"`
+	Price      []PriceBucket               `json:"price,omitempty"`
+	Categories []CategoryFacet             `json:"categories,omitempty"`
+	Attributes map[string][]AttributeFacet `json:"attributes,omitempty"`
+}
+
+func (f *SearchFacets) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case []byte:
+		return json.Unmarshal(value, f)
+	case string:
+		return json.Unmarshal([]byte(value), f)
+	}
+	return fmt.Errorf("неподдерживаемый тип значения фасетов %T", src)
+}
+
+// Проверить список запрошенных фасетов
+func validFacets(facets []string) bool {
+	for _, facet := range facets {
+		switch facet {
+		case "sellers", "price", "categories", "attributes":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Список фасетов из параметра запроса: через запятую (facets=sellers,price) или повторением параметра
+func queryFacets(values []string) []string {
+	var facets []string
+	for _, value := range values {
+		for _, facet := range strings.Split(value, ",") {
+			facets = append(facets, strings.TrimSpace(facet))
+		}
+	}
+	return facets
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Фид -- прайс-лист продавца, периодически загружаемый по url
+type Feed struct {
+	SellerId     int     `json:"seller_id"`
+	FeedUrl      string  `json:"feed_url"`
+	Schedule     string  `json:"schedule"`
+	LastChecked  *string `json:"last_checked"`
+	LastTaskId   *int    `json:"last_task_id"`
+	LastError    *string `json:"last_error"`
+	ETag         *string `json:"-"`
+	LastModified *string `json:"-"`
+	ContentHash  *string `json:"-"`
+}
+
+// результат загрузки фида
+type feedResult struct {
+	File         *uploadedFile
+	ETag         *string
+	LastModified *string
+	ContentHash  *string
+	Changed      bool
+}
+
+// продавцы, фиды которых загружаются в данный момент
+var feedsInProgress sync.Map
+
+// Скачать фид, учитывая ETag/Last-Modified и хеш содержимого предыдущей загрузки
+func fetchFeed(client *http.Client, feed Feed, limit int64) (*feedResult, error) {
+	request, err := http.NewRequest("GET", feed.FeedUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if feed.ETag != nil {
+		request.Header.Set("If-None-Match", *feed.ETag)
+	}
+	if feed.LastModified != nil {
+		request.Header.Set("If-Modified-Since", *feed.LastModified)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return &feedResult{ETag: feed.ETag, LastModified: feed.LastModified, ContentHash: feed.ContentHash}, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("сервер вернул статус %d", response.StatusCode)
+	}
+
+	file, err := saveUpload(response.Body, path.Base(request.URL.Path), limit)
+	if err != nil {
+		return nil, err
+	}
+	result := feedResult{
+		File:        file,
+		ContentHash: &file.Hash,
+		Changed:     feed.ContentHash == nil || *feed.ContentHash != file.Hash,
+	}
+	if etag := response.Header.Get("ETag"); etag != "" {
+		result.ETag = &etag
+	}
+	if lastModified := response.Header.Get("Last-Modified"); lastModified != "" {
+		result.LastModified = &lastModified
+	}
+	return &result, nil
+}
+
+// Загрузить фид продавца и, если файл изменился, создать задачу на загрузку товаров
+func pullFeed(db *sql.DB, feed Feed) {
+	if _, running := feedsInProgress.LoadOrStore(feed.SellerId, true); running {
+		return
+	}
+	defer feedsInProgress.Delete(feed.SellerId)
+
+	// ETag, Last-Modified и хеш сохраняются вместе с задачей на загрузку товаров и учитываются,
+	// только если эта задача завершилась успешно
+	status, err := feedTaskStatus(db, feed)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	switch status {
+	case "Скачивание", "Выполняется":
+		// товары предыдущей версии фида еще загружаются
+		return
+	case "", "Завершен", "Без изменений":
+	default:
+		feed.ETag, feed.LastModified, feed.ContentHash = nil, nil, nil
+	}
+
+	maxBytes, _, err := sellerLimits(db, feed.SellerId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	result, err := fetchFeed(downloadClient, feed, maxBytes)
+	if err != nil {
+		_, err = db.Exec("UPDATE offers.Feed SET last_checked = CURRENT_TIMESTAMP, last_error = $2 WHERE seller_id = $1;",
+			feed.SellerId, err.Error())
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	taskId := sql.NullInt32{}
+	if result.Changed {
+		id, err := startLoadTask(db, result.File, "", feed.SellerId, &feed.FeedUrl)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		taskId = sql.NullInt32{Int32: int32(id), Valid: true}
+	} else if result.File != nil {
+		result.File.Remove()
+	}
+	query := `UPDATE offers.Feed
+              SET etag = $2, last_modified = $3, content_hash = $4, last_task_id = COALESCE($5, last_task_id),
+                  last_checked = CURRENT_TIMESTAMP, last_error = NULL
+              WHERE seller_id = $1;`
+	_, err = db.Exec(query, feed.SellerId, result.ETag, result.LastModified, result.ContentHash, taskId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Статус задачи последней загрузки фида, пустая строка -- фид еще не загружался
+func feedTaskStatus(db *sql.DB, feed Feed) (string, error) {
+	if feed.LastTaskId == nil {
+		return "", nil
+	}
+	var status string
+	err := db.QueryRow("SELECT status FROM offers.Task WHERE task_id = $1;", *feed.LastTaskId).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// Получить фид продавца, nil -- если фид не настроен
+func loadFeed(db *sql.DB, sellerId int) (*Feed, error) {
+	query := `SELECT seller_id, feed_url, schedule, last_checked, last_task_id, last_error, etag, last_modified, content_hash
+              FROM offers.Feed WHERE seller_id = $1;`
+	var feed Feed
+	err := db.QueryRow(query, sellerId).Scan(&feed.SellerId, &feed.FeedUrl, &feed.Schedule, &feed.LastChecked,
+		&feed.LastTaskId, &feed.LastError, &feed.ETag, &feed.LastModified, &feed.ContentHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+// Проверка расписаний фидов, выполняется в начале каждой минуты
+func runFeedScheduler(db *sql.DB) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		result, err := db.Query(`SELECT seller_id, feed_url, schedule, last_checked, last_task_id, last_error, etag, last_modified, content_hash
+                                 FROM offers.Feed;`)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		var feeds []Feed
+		for result.Next() {
+			var feed Feed
+			err = result.Scan(&feed.SellerId, &feed.FeedUrl, &feed.Schedule, &feed.LastChecked,
+				&feed.LastTaskId, &feed.LastError, &feed.ETag, &feed.LastModified, &feed.ContentHash)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			feeds = append(feeds, feed)
+		}
+		result.Close()
+
+		for _, feed := range feeds {
+			schedule, err := parseSchedule(feed.Schedule)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if schedule.Match(next) {
+				go pullFeed(db, feed)
+			}
+		}
+	}
+}
+
+func setFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	var feed Feed
+	err = json.Unmarshal(body, &feed)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return
+	}
+	if !validHttpUrl(feed.FeedUrl) {
+		sendErrorMessage(w, "Неверный формат feed_url! Ожидается http или https адрес", http.StatusBadRequest)
+		return
+	}
+	if _, err = parseSchedule(feed.Schedule); err != nil {
+		sendErrorMessage(w, "Неверный формат schedule! Ожидается расписание в формате cron", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("SELECT offers.set_feed($1, $2, $3);", sellerId, feed.FeedUrl, feed.Schedule)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	savedFeed, err := loadFeed(db, sellerId)
+	if err != nil || savedFeed == nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(savedFeed)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func getFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+	feed, err := loadFeed(db, sellerId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if feed == nil {
+		sendErrorMessage(w, "Для продавца не настроен фид!", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(feed)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func deleteFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("DELETE FROM offers.Feed WHERE seller_id = $1;", sellerId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
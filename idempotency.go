@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// время, в течение которого повторный запрос с тем же Idempotency-Key возвращает исходный результат
+var idempotencyWindow = 24 * time.Hour
+
+// время, после которого ключ без сохраненного результата считается оставшимся от прерванного
+// запроса и может быть зарезервирован заново
+var idempotencyPendingTimeout = time.Minute
+
+// Хеш данных запроса для сравнения повторных запросов с тем же ключом идемпотентности
+func requestHash(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Зарезервировать ключ идемпотентности. Если ключ уже использован, вернет идентификатор,
+// полученный при исходном запросе (nil -- исходный запрос еще выполняется), и совпадает ли
+// хеш запроса с хешем исходного запроса
+func reserveIdempotencyKey(db *sql.DB, scope string, key string, hash string) (bool, *int, bool, error) {
+	var isNew, sameRequest bool
+	var originalId *int
+	query := "SELECT is_new, original_id, same_request FROM offers.reserve_idempotency_key($1, $2, $3, $4, $5);"
+	err := db.QueryRow(query, scope, key, int(idempotencyWindow.Seconds()), hash,
+		int(idempotencyPendingTimeout.Seconds())).Scan(&isNew, &originalId, &sameRequest)
+	if err != nil {
+		return false, nil, false, err
+	}
+	return isNew, originalId, sameRequest, nil
+}
+
+// Проверить заголовок Idempotency-Key. Вернет true, если запрос с таким ключом уже был
+// и ответ клиенту отправлен. hash -- хеш данных запроса (см. requestHash),
+// resultKey -- имя поля с идентификатором в ответе
+func checkIdempotencyKey(w http.ResponseWriter, r *http.Request, scope string, hash string, resultKey string, statusCode int) (string, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", false
+	}
+	if len(key) > 255 {
+		sendErrorMessage(w, "недопустимое значение заголовка Idempotency-Key", http.StatusBadRequest)
+		return "", true
+	}
+	isNew, originalId, sameRequest, err := reserveIdempotencyKey(db, scope, key, hash)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return "", true
+	}
+	if isNew {
+		return key, false
+	}
+	if !sameRequest {
+		sendErrorMessage(w, "Idempotency-Key уже использован для запроса с другими данными", http.StatusUnprocessableEntity)
+		return "", true
+	}
+	if originalId == nil {
+		sendErrorMessage(w, "запрос с указанным Idempotency-Key еще выполняется", http.StatusConflict)
+		return "", true
+	}
+	w.WriteHeader(statusCode)
+	err = json.NewEncoder(w).Encode(map[string]int{resultKey: *originalId})
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return "", true
+}
+
+// Сохранить результат запроса для ключа идемпотентности
+func saveIdempotencyKey(db *sql.DB, scope string, key string, resultId int) {
+	if key == "" {
+		return
+	}
+	_, err := db.Exec("UPDATE offers.IdempotencyKey SET result_id = $3 WHERE scope = $1 AND idempotency_key = $2;",
+		scope, key, resultId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Освободить ключ идемпотентности, если запрос не был выполнен
+func releaseIdempotencyKey(db *sql.DB, scope string, key string) {
+	if key == "" {
+		return
+	}
+	_, err := db.Exec("DELETE FROM offers.IdempotencyKey WHERE scope = $1 AND idempotency_key = $2;", scope, key)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidOds = errors.New("некорректный формат ods файла")
+
+const odsMimeType = "application/vnd.oasis.opendocument.spreadsheet"
+
+// максимальное количество столбцов, в которое разворачиваются повторяющиеся ячейки
+const odsMaxColumns = 16384
+
+// максимальная длина текста ячейки, более длинный текст (в том числе из повторяющихся пробелов) обрезается
+const odsMaxCellText = 32767
+
+// Потоковое чтение строк ods файла: content.xml разбирается по мере чтения.
+// Пустые строки в конце листа (в том числе заданные через number-rows-repeated) пропускаются
+type odsRows struct {
+	archive     *zip.ReadCloser
+	reader      io.ReadCloser
+	decoder     *xml.Decoder
+	blankRows   int
+	emptyRows   int
+	row         []string
+	rowRepeated int
+	selection   *sheetSelection
+}
+
+// Проверить, является ли zip архив ods документом
+func isOdsArchive(archive *zip.ReadCloser) bool {
+	file := findZipFile(archive, "mimetype")
+	if file == nil {
+		return false
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	mimeType, err := ioutil.ReadAll(io.LimitReader(reader, 256))
+	return err == nil && strings.TrimSpace(string(mimeType)) == odsMimeType
+}
+
+// Открыть ods файл для потокового чтения
+func openOdsRows(filePath string) (*odsRows, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, errInvalidOds
+	}
+	content := findZipFile(archive, "content.xml")
+	if !isOdsArchive(archive) || content == nil {
+		archive.Close()
+		return nil, errInvalidOds
+	}
+	// content.xml ограничен так же, как листы xlsx файла
+	reader, err := openXlsxPart(content, maxArchiveBytes, errArchiveTooLarge)
+	if err != nil {
+		archive.Close()
+		return nil, odsError(err)
+	}
+	return &odsRows{archive: archive, reader: reader, decoder: xml.NewDecoder(reader)}, nil
+}
+
+// Ошибка чтения ods файла: превышение ограничений возвращается как есть, остальные -- errInvalidOds
+func odsError(err error) error {
+	if err == errArchiveTooLarge || err == errArchiveRatio {
+		return err
+	}
+	return errInvalidOds
+}
+
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Значение атрибута number-*-repeated, по умолчанию 1
+func repeatedAttr(element xml.StartElement, name string) (int, error) {
+	value := xmlAttr(element, name)
+	if value == "" {
+		return 1, nil
+	}
+	repeated, err := strconv.Atoi(value)
+	if err != nil || repeated < 1 {
+		return 0, errInvalidOds
+	}
+	return repeated, nil
+}
+
+// Следующая строка листа. Пустые строки между строками с данными возвращаются как пустые
+func (o *odsRows) Next() ([]string, error) {
+	for {
+		if o.emptyRows > 0 {
+			o.emptyRows--
+			return []string{}, nil
+		}
+		if o.rowRepeated > 0 {
+			o.rowRepeated--
+			return append([]string(nil), o.row...), nil
+		}
+
+		token, err := o.decoder.Token()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, odsError(err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "table" && !o.selection.include(xmlAttr(t, "name")) {
+				if err = o.decoder.Skip(); err != nil {
+					return nil, odsError(err)
+				}
+				continue
+			}
+			if t.Name.Local != "table-row" {
+				continue
+			}
+			repeated, err := repeatedAttr(t, "number-rows-repeated")
+			if err != nil {
+				return nil, err
+			}
+			row, err := o.readRow()
+			if err != nil {
+				return nil, odsError(err)
+			}
+			if len(row) == 0 {
+				o.blankRows += repeated
+				continue
+			}
+			o.emptyRows, o.blankRows = o.blankRows, 0
+			o.row, o.rowRepeated = row, repeated
+		case xml.EndElement:
+			if t.Name.Local == "table" {
+				o.blankRows = 0
+			}
+		}
+	}
+}
+
+// Прочитать ячейки строки до закрывающего тега table-row. Пустые ячейки в конце строки отбрасываются
+func (o *odsRows) readRow() ([]string, error) {
+	row := []string{}
+	blankCells := 0
+	for {
+		token, err := o.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.EndElement:
+			if t.Name.Local == "table-row" {
+				return row, nil
+			}
+		case xml.StartElement:
+			if t.Name.Local != "table-cell" && t.Name.Local != "covered-table-cell" {
+				continue
+			}
+			repeated, err := repeatedAttr(t, "number-columns-repeated")
+			if err != nil {
+				return nil, err
+			}
+			value, err := o.readCell(t)
+			if err != nil {
+				return nil, err
+			}
+			if value == "" {
+				blankCells += repeated
+				continue
+			}
+			for ; blankCells > 0 && len(row) < odsMaxColumns; blankCells-- {
+				row = append(row, "")
+			}
+			blankCells = 0
+			for ; repeated > 0 && len(row) < odsMaxColumns; repeated-- {
+				row = append(row, value)
+			}
+		}
+	}
+}
+
+// Значение ячейки с учетом ее типа: для чисел и дат используется значение атрибута, для строк -- текст
+func (o *odsRows) readCell(cell xml.StartElement) (string, error) {
+	text, err := o.readCellText(cell.Name.Local)
+	if err != nil {
+		return "", err
+	}
+	switch xmlAttr(cell, "value-type") {
+	case "float", "percentage", "currency":
+		return xmlAttr(cell, "value"), nil
+	case "date":
+		return xmlAttr(cell, "date-value"), nil
+	case "time":
+		return xmlAttr(cell, "time-value"), nil
+	case "boolean":
+		if xmlAttr(cell, "boolean-value") == "true" {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	}
+	return text, nil
+}
+
+// Текст ячейки: абзацы разделяются переводом строки, примечания пропускаются.
+// Текст длиннее odsMaxCellText обрезается
+func (o *odsRows) readCellText(cellName string) (string, error) {
+	var text strings.Builder
+	write := func(value string) {
+		if rest := odsMaxCellText - text.Len(); len(value) > rest {
+			// обрезается по границе символа
+			for rest > 0 && !utf8.RuneStart(value[rest]) {
+				rest--
+			}
+			value = value[:rest]
+		}
+		text.WriteString(value)
+	}
+	paragraphs, depth := 0, 0
+	for {
+		token, err := o.decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			if depth > 0 {
+				write(string(t))
+			}
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "annotation":
+				if err = o.decoder.Skip(); err != nil {
+					return "", err
+				}
+			case "p":
+				if paragraphs > 0 {
+					write("\n")
+				}
+				paragraphs++
+				depth++
+			case "s":
+				count, err := repeatedAttr(t, "c")
+				if err != nil {
+					return "", err
+				}
+				if rest := odsMaxCellText - text.Len(); count > rest {
+					count = rest
+				}
+				write(strings.Repeat(" ", count))
+			case "tab":
+				write("\t")
+			case "line-break":
+				write("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "p":
+				depth--
+			case cellName:
+				return text.String(), nil
+			}
+		}
+	}
+}
+
+func (o *odsRows) Close() error {
+	o.reader.Close()
+	return o.archive.Close()
+}
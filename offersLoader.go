@@ -1,22 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
-	"github.com/tealeg/xlsx"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Seller struct {
@@ -28,19 +29,39 @@ type Seller struct {
 type Offer struct {
 	OfferId int `json:"offer_id"`
 	Name string `json:"offer_name"`
-	Price int `json:"price"`
+	Price Price `json:"price"`
 	Quantity int `json:"quantity"`
+	Currency string `json:"currency"`
 }
 
 // структура для сериализации товаров в json для возвращения клиенту
 type OutputOffer struct {
 	Offer
+	// цена в рублях по курсу из offers.ExchangeRate, null -- курс валюты не задан
+	PriceRub *Price `json:"price_rub"`
+	// старая цена и окончание действия скидки, выводятся только для действующей скидки
+	OldPrice *Price `json:"old_price,omitempty"`
+	DiscountTo *string `json:"discount_to,omitempty"`
+	CategoryId *int `json:"category_id,omitempty"`
+	Attributes Attributes `json:"attributes,omitempty"`
+	// адреса изображений, кроме недоступных
+	Pictures []string `json:"pictures,omitempty"`
+	// название с выделенными словами запроса и релевантность, выводятся для полнотекстового и нечеткого поиска
+	Highlight *string `json:"highlight,omitempty"`
+	Relevance *float64 `json:"relevance,omitempty"`
 	SellerData Seller `json:"seller"`
 }
 
 // структура для загрузки товаров из excel
 type ExcelOffer struct {
 	Offer
+	OldPrice *Price `json:"old_price"`
+	DiscountFrom *time.Time `json:"discount_from"`
+	DiscountTo *time.Time `json:"discount_to"`
+	CategoryId *int `json:"category_id"`
+	Attributes Attributes `json:"attributes"`
+	// адреса изображений по порядку, null -- изображения товара не изменяются
+	Pictures []string `json:"pictures"`
 	SellerId int `json:"seller_id"`
 	Available bool `json:"available"`
 }
@@ -55,14 +76,11 @@ type Task struct {
 	NumUpdated *int `json:"num_updated"`
 	NumDeleted *int `json:"num_deleted"`
 	SellerData Seller `json:"seller"`
-}
-
-// структура для получения входных данных обработчика /offers/search
-type SearchOffer struct {
-	OfferId *int `json:"offer_id"`
-	OfferName *string `json:"offer_name"`
-	SellerId *int `json:"seller_id"`
-	IgnoreRegister *bool `json:"ignore_register"`
+	SourceUrl *string `json:"source_url"`
+	FileSize *int `json:"file_size"`
+	ErrorMessage *string `json:"error_message"`
+	Sheets *SheetReport `json:"sheets,omitempty"`
+	Files []TaskFile `json:"files,omitempty"`
 }
 
 // Отправить клиенты сообщение о возникшей ошибке
@@ -75,29 +93,111 @@ func sendErrorMessage(w http.ResponseWriter, messageText string, statusCode int)
 	}
 }
 
+// Проверить существование продавца с идентификатором из url
+func sellerFromParams(r *http.Request) (int, bool, error) {
+	sellerId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, false, nil
+	}
+	var sellerExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT * FROM offers.Seller WHERE seller_id = $1);", sellerId).Scan(&sellerExists)
+	if err != nil {
+		return 0, false, err
+	}
+	return sellerId, sellerExists, nil
+}
+
+// Источник строк табличного файла
+type rowSource interface {
+	// Следующая строка в виде значений ячеек, io.EOF -- строки закончились
+	Next() ([]string, error)
+	Close() error
+}
+
+// Значение ячейки строки, отсутствующие ячейки считаются пустыми
+func cellValue(cells []string, index int) string {
+	if index < len(cells) {
+		return cells[index]
+	}
+	return ""
+}
+
+// Целочисленное значение ячейки, дробная часть отбрасывается
+func cellInt(cells []string, index int) (int, error) {
+	value, err := strconv.ParseFloat(cellValue(cells, index), 64)
+	if err != nil {
+		return -1, err
+	}
+	return int(value), nil
+}
+
+// форматы даты и времени в ячейках, кроме дат excel в виде числа
+var cellTimeLayouts = []string{"2006-01-02", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04",
+	"02.01.2006", "02.01.2006 15:04:05", "02.01.2006 15:04"}
+
+// Дата и время из ячейки, пустая ячейка -- nil. Дата excel хранится как число дней с 30.12.1899.
+// endOfDay -- дата без времени означает конец дня (начало следующего дня)
+func cellTime(cells []string, index int, endOfDay bool) (*time.Time, error) {
+	value := strings.TrimSpace(cellValue(cells, index))
+	if value == "" {
+		return nil, nil
+	}
+	var result time.Time
+	dateOnly := false
+	if days, err := strconv.ParseFloat(value, 64); err == nil {
+		if days <= 0 || days > 2958465 {
+			return nil, errors.New("некорректная дата")
+		}
+		seconds := math.Round(days * 24 * 60 * 60)
+		result = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(seconds) * time.Second)
+		dateOnly = days == math.Trunc(days)
+	} else {
+		parsed := false
+		for i, layout := range cellTimeLayouts {
+			if result, err = time.Parse(layout, value); err == nil {
+				parsed, dateOnly = true, i == 0 || layout == "02.01.2006"
+				break
+			}
+		}
+		if !parsed {
+			return nil, errors.New("некорректная дата")
+		}
+	}
+	if endOfDay && dateOnly {
+		result = result.AddDate(0, 0, 1)
+	}
+	return &result, nil
+}
+
 // Извлечение данных из строки excel файла
-func OfferFromRow(row *xlsx.Row) (*ExcelOffer, error) {
-	OfferId, err := row.GetCell(0).Int()
+func OfferFromCells(cells []string) (*ExcelOffer, error) {
+	OfferId, err := cellInt(cells, 0)
 	if err != nil {
 		return nil, errors.New("ошибка при обработке строки excel")
 	}
-	name := row.GetCell(1).String()
+	name := cellValue(cells, 1)
 	if name == "" {
 		return nil, errors.New("ошибка при обработке строки excel")
 	}
-	Price, err := row.GetCell(2).Int()
+	Price, err := parsePrice(cellValue(cells, 2))
 	if err != nil {
 		return nil, errors.New("ошибка при обработке строки excel")
-	} else if Price < 0 {
-		return nil, errors.New("ошибка при обработке строки excel")
 	}
-	Quantity, err := row.GetCell(3).Int()
+	Quantity, err := cellInt(cells, 3)
 	if err != nil {
 		return nil, errors.New("ошибка при обработке строки excel")
-	} else if Quantity <= 0 {
+	} else if Quantity < 0 {
 		return nil, errors.New("ошибка при обработке строки excel")
 	}
-	Available := row.GetCell(4).String()
+	Available := cellValue(cells, 4)
+	// валюта цены (необязательный столбец), если не указана -- валюта продавца по умолчанию
+	Currency := ""
+	if value := strings.TrimSpace(cellValue(cells, 5)); value != "" {
+		Currency, err = parseCurrency(value)
+		if err != nil {
+			return nil, errors.New("ошибка при обработке строки excel")
+		}
+	}
 
 	offer := ExcelOffer{
 		Offer: Offer{
@@ -105,6 +205,7 @@ func OfferFromRow(row *xlsx.Row) (*ExcelOffer, error) {
 			Name:     name,
 			Price:    Price,
 			Quantity: Quantity,
+			Currency: Currency,
 		},
 	}
 	if Available == "true" {
@@ -114,79 +215,310 @@ func OfferFromRow(row *xlsx.Row) (*ExcelOffer, error) {
 	} else {
 		return nil, errors.New("ошибка при обработке строки excel")
 	}
+
+	// старая (зачеркнутая) цена и период действия скидки -- необязательные столбцы
+	if value := strings.TrimSpace(cellValue(cells, 6)); value != "" {
+		OldPrice, err := parsePrice(value)
+		if err != nil || OldPrice <= Price {
+			return nil, errors.New("ошибка при обработке строки excel")
+		}
+		offer.OldPrice = &OldPrice
+	}
+	offer.DiscountFrom, err = cellTime(cells, 7, false)
+	if err != nil {
+		return nil, errors.New("ошибка при обработке строки excel")
+	}
+	offer.DiscountTo, err = cellTime(cells, 8, true)
+	if err != nil {
+		return nil, errors.New("ошибка при обработке строки excel")
+	}
+	if (offer.DiscountFrom != nil || offer.DiscountTo != nil) && offer.OldPrice == nil {
+		return nil, errors.New("ошибка при обработке строки excel")
+	}
+	if offer.DiscountFrom != nil && offer.DiscountTo != nil && !offer.DiscountFrom.Before(*offer.DiscountTo) {
+		return nil, errors.New("ошибка при обработке строки excel")
+	}
+
+	// идентификатор категории из /categories -- необязательный столбец
+	if strings.TrimSpace(cellValue(cells, 9)) != "" {
+		CategoryId, err := cellInt(cells, 9)
+		if err != nil || CategoryId <= 0 {
+			return nil, errors.New("ошибка при обработке строки excel")
+		}
+		offer.CategoryId = &CategoryId
+	}
 	return &offer, nil
 }
 
 // Изменить статус задачи на "Ошибка"
-func taskSetError(db *sql.DB, taskId int) error {
-	query := "UPDATE offers.Task SET finish_date = CURRENT_TIMESTAMP, status = 'Ошибка' WHERE task_id = $1"
+func taskSetError(db *sql.DB, taskId int, message string) error {
+	query := "UPDATE offers.Task SET finish_date = CURRENT_TIMESTAMP, status = 'Ошибка', error_message = $2 WHERE task_id = $1"
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(taskId)
+	_, err = stmt.Exec(taskId, message)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// открытие excel файла для чтения
-func readExcelFile(db* sql.DB, buf* bytes.Buffer, sellerId int, taskId int) {
-	errorCounter := 0
-	var offers []ExcelOffer
-	wb, err := xlsx.OpenBinary(buf.Bytes())
+// Товар продавца из строки файла с учетом настроек продавца options: основные поля, атрибуты и изображения
+func offerFromRow(cells []string, sellerId int, options importOptions) (*ExcelOffer, error) {
+	offer, err := OfferFromCells(cells)
 	if err != nil {
-		if err = taskSetError(db, taskId); err != nil {
-			log.Fatal(err.Error())
+		return nil, err
+	}
+	offer.Attributes, err = AttributesFromCells(cells, options.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	offer.Pictures, err = PicturesFromCells(cells, options.PictureColumn)
+	if err != nil {
+		return nil, err
+	}
+	offer.SellerId = sellerId
+	if offer.Currency == "" {
+		offer.Currency = options.Currency
+	}
+	return offer, nil
+}
+
+var errTooManyRows = errors.New("количество строк в файле превышает допустимое")
+var errNoValidRows = errors.New("файл не содержит корректных строк")
+
+// Передать корректные строки файла в writer с учетом настроек продавца options.
+// Вернет количество строк с ошибками и общее количество строк
+func loadOfferRows(rows rowSource, writer offersWriter, sellerId int, options importOptions, maxRows int) (int, int, error) {
+	errorCounter, rowCounter, validCounter := 0, 0, 0
+	for {
+		cells, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		rowCounter++
+		if rowCounter > maxRows {
+			return 0, 0, errTooManyRows
+		}
+		offer, err := offerFromRow(cells, sellerId, options)
+		if err != nil {
+			errorCounter++
+			continue
+		}
+		if err = writer.Write(*offer); err != nil {
+			return 0, 0, err
+		}
+		validCounter++
+	}
+	if validCounter == 0 {
+		return 0, 0, errNoValidRows
+	}
+	return errorCounter, rowCounter, nil
+}
+
+// Загрузить товары из выбранных листов табличного файла и слить их с offers.Offer.
+// Вернет счетчики изменений и количество прочитанных строк
+func loadFile(writer *copyOffersWriter, file *uploadedFile, selection *sheetSelection, sellerId int,
+	options importOptions, maxRows int) (loadCounters, int, error) {
+	var counters loadCounters
+	format, err := detectFileFormat(file.Path, file.Name)
+	if err != nil {
+		return counters, 0, err
+	}
+	if format == formatYml {
+		// структура yml файла не зависит от настроек столбцов продавца
+		options = importOptions{Currency: options.Currency, PictureColumn: ymlPictureColumn}
+	}
+	rows, err := openRows(file.Path, format, selection)
+	if err != nil {
+		return counters, 0, err
+	}
+	defer rows.Close()
+	errorCounter, rowCounter, err := loadOfferRows(rows, writer, sellerId, options, maxRows)
+	if err == errNoValidRows && selection.missing() {
+		return counters, 0, errSheetNotFound
+	}
+	if err != nil {
+		return counters, 0, err
+	}
+	counters, err = writer.Finish()
+	if err != nil {
+		return counters, 0, err
+	}
+	counters.Errors += errorCounter
+	return counters, rowCounter, nil
+}
+
+// Загрузить файл или архив с файлами в базу через COPY в рамках одной транзакции и завершить задачу.
+// Сжатый gzip файл предварительно распаковывается, размер распакованного файла не более maxBytes.
+// sheet -- название или номер листа вида "#2" для загрузки, пустая строка -- все листы
+func applyUpload(db *sql.DB, file *uploadedFile, sheet string, sellerId int, taskId int, maxBytes int64, maxRows int) error {
+	gzipped, err := isGzipFile(file.Path)
+	if err != nil {
+		return err
+	}
+	if gzipped {
+		unpacked, err := gunzipUpload(file, maxBytes)
+		if err != nil {
+			return err
+		}
+		defer unpacked.Remove()
+		file = unpacked
+	}
+	format, err := detectFileFormat(file.Path, file.Name)
+	if err != nil {
+		return err
+	}
+	options, err := sellerImportOptions(db, sellerId)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	writer, err := newCopyOffersWriter(tx, taskId)
+	if err != nil {
+		return err
+	}
+	var counters loadCounters
+	if format == formatZip {
+		var files []TaskFile
+		files, counters, err = loadArchive(writer, file.Path, sheet, sellerId, options, maxRows)
+		if err == nil {
+			err = insertTaskFiles(tx, taskId, files)
 		}
 	} else {
-		for _, sheet := range wb.Sheets {
-			for i := 0; i < sheet.MaxRow; i++ {
-				row, err := sheet.Row(i)
-				if err != nil {
-					errorCounter++
-					continue
-				}
-				offer, err := OfferFromRow(row)
-				if err != nil {
-					errorCounter++
-					continue
-				}
-
-				offer.SellerId = sellerId
-				offers = append(offers, *offer)
-			}
+		selection := newSheetSelection(sheet)
+		counters, _, err = loadFile(writer, file, selection, sellerId, options, maxRows)
+		if err == nil {
+			err = setTaskSheets(tx, taskId, selection.Report())
 		}
-		jsonOffers, err := json.Marshal(offers)
-		if string(jsonOffers) != "null" {
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+	}
+	if err != nil {
+		return err
+	}
+	if err = finishTask(tx, taskId, counters); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-			stmt, err := db.Prepare("SELECT offers.load_offers($1, $2, $3);")
-			if err != nil {
-				log.Fatal(err.Error())
-			}
-			defer stmt.Close()
-			if string(jsonOffers) != "null" {
+// Сообщение об ошибке обработки содержимого файла
+func fileErrorMessage(err error) string {
+	if err == errNoValidRows || err == errSheetNotFound {
+		return err.Error()
+	}
+	return "некорректный формат файла"
+}
 
-			}
-			_, err = stmt.Exec(errorCounter, taskId, jsonOffers)
-			if err != nil {
-				if err = taskSetError(db, taskId); err != nil {
-					log.Fatal(err.Error())
-				}
-			}
-		} else {
-			if err = taskSetError(db, taskId); err != nil {
-				log.Fatal(err.Error())
-			}
+// Сообщение об ошибке загрузки для задачи
+func loadErrorMessage(err error, maxBytes int64, maxRows int) string {
+	switch {
+	case err == errTooManyRows:
+		return fmt.Sprintf("количество строк в файле превышает допустимое (%d)", maxRows)
+	case err == errNoValidRows || invalidFileFormat(err):
+		return fileErrorMessage(err)
+	case err == errFileTooLarge:
+		return fmt.Sprintf("размер распакованного файла превышает допустимый (%d байт)", maxBytes)
+	case err == errArchiveTooManyEntries:
+		return fmt.Sprintf("архив содержит слишком много файлов (допустимо не более %d)", maxArchiveEntries)
+	case err == errArchiveTooLarge:
+		return fmt.Sprintf("размер распакованных файлов архива превышает допустимый (%d байт)", maxArchiveBytes)
+	case err == errArchiveRatio:
+		return fmt.Sprintf("степень сжатия файла в архиве превышает допустимую (%d)", maxCompressionRatio)
+	case err == errXlsxPartTooLarge:
+		return fmt.Sprintf("размер распакованной части xlsx файла превышает допустимый (%d байт)", maxXlsxXmlBytes)
+	}
+	return "ошибка при сохранении товаров"
+}
+
+// открытие excel файла для чтения
+func readExcelFile(db *sql.DB, file *uploadedFile, sheet string, sellerId int, taskId int) {
+	defer file.Remove()
+	maxBytes, maxRows, err := sellerLimits(db, sellerId)
+	if err != nil {
+		log.Println(err.Error())
+		if err = taskSetError(db, taskId, "ошибка при сохранении товаров"); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	err = applyUpload(db, file, sheet, sellerId, taskId, maxBytes, maxRows)
+	if err != nil {
+		if err = taskSetError(db, taskId, loadErrorMessage(err, maxBytes, maxRows)); err != nil {
+			log.Println(err.Error())
 		}
 	}
 }
 
+// Изменить статус задачи на "Без изменений" -- файл совпадает с последним успешно загруженным
+func taskSetUnchanged(db *sql.DB, taskId int) error {
+	query := `UPDATE offers.Task
+              SET finish_date = CURRENT_TIMESTAMP, status = 'Без изменений',
+                  num_errors = 0, num_created = 0, num_updated = 0, num_deleted = 0
+              WHERE task_id = $1`
+	_, err := db.Exec(query, taskId)
+	return err
+}
+
+// Проверить, совпадает ли файл с последним успешно загруженным файлом продавца
+func fileUnchanged(db *sql.DB, sellerId int, fileHash string, sheet string) (bool, error) {
+	var unchanged bool
+	err := db.QueryRow("SELECT COALESCE(offers.last_applied_hash($1, $3) = $2, FALSE);", sellerId, fileHash,
+		sql.NullString{String: sheet, Valid: sheet != ""}).Scan(&unchanged)
+	return unchanged, err
+}
+
+// Создать задачу продавца с указанным начальным статусом
+func insertTask(db *sql.DB, sellerId int, status string, sourceUrl *string, fileSize *int, fileHash *string, sheet string) (int, error) {
+	var taskId int
+	stmt, err := db.Prepare("SELECT offers.insert_task($1, $2, $3, $4, $5, $6);")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(sellerId, status, sourceUrl, fileSize, fileHash, sql.NullString{String: sheet, Valid: sheet != ""}).Scan(&taskId)
+	if err != nil {
+		return 0, err
+	}
+	return taskId, nil
+}
+
+// Создать задачу на загрузку товаров продавца и запустить обработку файла.
+// Если файл не изменился с последней успешной загрузки, задача сразу завершается
+func startLoadTask(db *sql.DB, file *uploadedFile, sheet string, sellerId int, sourceUrl *string) (int, error) {
+	fileSize := int(file.Size)
+	sheet, err := sellerSheet(db, sellerId, sheet)
+	if err != nil {
+		file.Remove()
+		return 0, err
+	}
+	unchanged, err := fileUnchanged(db, sellerId, file.Hash, sheet)
+	if err != nil {
+		file.Remove()
+		return 0, err
+	}
+	taskId, err := insertTask(db, sellerId, "Выполняется", sourceUrl, &fileSize, &file.Hash, sheet)
+	if err != nil {
+		file.Remove()
+		return 0, err
+	}
+	if unchanged {
+		file.Remove()
+		return taskId, taskSetUnchanged(db, taskId)
+	}
+	go readExcelFile(db, file, sheet, sellerId, taskId)
+	return taskId, nil
+}
+
 var db *sql.DB
 var err error
 
@@ -210,6 +542,56 @@ func main() {
 		panic(err.Error())
 	}
 	defer db.Close()
+
+	if value, ok := os.LookupEnv("MAX_UPLOAD_BYTES"); ok {
+		maxUploadBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxUploadBytes <= 0 {
+			log.Fatal("MAX_UPLOAD_BYTES")
+		}
+	}
+	if value, ok := os.LookupEnv("MAX_ROWS"); ok {
+		maxRows, err = strconv.Atoi(value)
+		if err != nil || maxRows <= 0 {
+			log.Fatal("MAX_ROWS")
+		}
+	}
+	if value, ok := os.LookupEnv("MAX_ARCHIVE_ENTRIES"); ok {
+		maxArchiveEntries, err = strconv.Atoi(value)
+		if err != nil || maxArchiveEntries <= 0 {
+			log.Fatal("MAX_ARCHIVE_ENTRIES")
+		}
+	}
+	if value, ok := os.LookupEnv("MAX_ARCHIVE_BYTES"); ok {
+		maxArchiveBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxArchiveBytes <= 0 {
+			log.Fatal("MAX_ARCHIVE_BYTES")
+		}
+	}
+	if value, ok := os.LookupEnv("MAX_COMPRESSION_RATIO"); ok {
+		maxCompressionRatio, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxCompressionRatio <= 0 {
+			log.Fatal("MAX_COMPRESSION_RATIO")
+		}
+	}
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if value, ok := os.LookupEnv("FETCH_ALLOWED_NETWORKS"); ok {
+		allowedFetchNetworks = parseNetworks(value)
+		if allowedFetchNetworks == nil {
+			log.Fatal("FETCH_ALLOWED_NETWORKS")
+		}
+	}
+	if interval, ok := os.LookupEnv("PICTURE_CHECK_INTERVAL"); ok {
+		pictureCheckInterval, err = time.ParseDuration(interval)
+		if err != nil || pictureCheckInterval <= 0 {
+			log.Fatal("PICTURE_CHECK_INTERVAL")
+		}
+	}
+	if window, ok := os.LookupEnv("IDEMPOTENCY_WINDOW"); ok {
+		idempotencyWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatal("IDEMPOTENCY_WINDOW")
+		}
+	}
 	query := "UPDATE offers.Task SET finish_date = CURRENT_TIMESTAMP, status = 'Ошибка' WHERE finish_date IS NULL;"
 	stmt, err := db.Prepare(query)
 	if err != nil {
@@ -220,14 +602,41 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	go runFeedScheduler(db)
+	go runProductMatcher(db)
+	if pictureCheckInterval > 0 {
+		go runPictureChecker(db)
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/sellers", logHandler(createSeller)).Methods("POST")
 	router.HandleFunc("/sellers", logHandler(getAllSellers)).Methods("GET")
 	router.HandleFunc("/sellers/{id}", logHandler(getSeller)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/settings", logHandler(getSellerSettings)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/settings", logHandler(setSellerSettings)).Methods("PUT")
 	router.HandleFunc("/sellers/{id}/offers/load", logHandler(loadOffers)).Methods("POST")
-	router.HandleFunc("/offers/search", logHandler(searchOffers)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/offers/load-from-url", logHandler(loadOffersFromUrl)).Methods("POST")
+	router.HandleFunc("/sellers/{id}/offers", logHandler(createSellerOffer)).Methods("POST")
+	router.HandleFunc("/sellers/{id}/offers/{offer_id}", logHandler(getSellerOffer)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/offers/{offer_id}", logHandler(replaceSellerOffer)).Methods("PUT")
+	router.HandleFunc("/sellers/{id}/offers/{offer_id}", logHandler(patchSellerOffer)).Methods("PATCH")
+	router.HandleFunc("/sellers/{id}/offers/{offer_id}", logHandler(deleteSellerOffer)).Methods("DELETE")
+	router.HandleFunc("/sellers/{id}/feed", logHandler(setFeed)).Methods("PUT")
+	router.HandleFunc("/sellers/{id}/feed", logHandler(getFeed)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/feed", logHandler(deleteFeed)).Methods("DELETE")
+	router.HandleFunc("/offers/search", logHandler(searchOffers)).Methods("GET", "POST")
+	router.HandleFunc("/offers/suggest", logHandler(suggestOffers)).Methods("GET")
+	router.HandleFunc("/products/{id}/offers", logHandler(getProductOffers)).Methods("GET")
+	router.HandleFunc("/sellers/{id}/offers/{offer_id}/product", logHandler(getOfferProduct)).Methods("GET")
+	router.HandleFunc("/categories", logHandler(getAllCategories)).Methods("GET")
+	router.HandleFunc("/categories", logHandler(createCategory)).Methods("POST")
+	router.HandleFunc("/categories/{id}", logHandler(getCategory)).Methods("GET")
+	router.HandleFunc("/categories/{id}", logHandler(updateCategory)).Methods("PUT")
+	router.HandleFunc("/categories/{id}", logHandler(deleteCategory)).Methods("DELETE")
 	router.HandleFunc("/tasks", logHandler(getAllTasks)).Methods("GET")
 	router.HandleFunc("/tasks/{id}", logHandler(getTask)).Methods("GET")
+	router.HandleFunc("/admin/exchange-rates", logHandler(getExchangeRates)).Methods("GET")
+	router.HandleFunc("/admin/exchange-rates", logHandler(setExchangeRates)).Methods("PUT")
 	router.NotFoundHandler = logHandler(handleNotFound)
 	router.MethodNotAllowedHandler = logHandler(handleMethodNotAllowed)
 
@@ -282,18 +691,22 @@ func createSeller(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if sellerNamePattern.MatchString(sellerName) {
-		var alreadyExists bool
-		result, err := db.Query("SELECT EXISTS(SELECT * FROM offers.Seller WHERE seller_name = $1);", sellerName)
-		if err != nil {
-			log.Fatal(err.Error())
+		idempotencyKey, handled := checkIdempotencyKey(w, r, "seller", requestHash(string(body)), "seller_id", http.StatusCreated)
+		if handled {
+			return
 		}
-		result.Next()
-		err = result.Scan(&alreadyExists)
+
+		var alreadyExists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT * FROM offers.Seller WHERE seller_name = $1);", sellerName).
+			Scan(&alreadyExists)
 		if err != nil {
-			log.Fatal(err.Error())
+			releaseIdempotencyKey(db, "seller", idempotencyKey)
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
 		}
 
 		if alreadyExists {
+			releaseIdempotencyKey(db, "seller", idempotencyKey)
 			w.WriteHeader(http.StatusBadRequest)
 			errorMessage := map[string]string{"message": "Продавец с указанным SellerName уже существует!"}
 			err = json.NewEncoder(w).Encode(errorMessage)
@@ -301,15 +714,13 @@ func createSeller(w http.ResponseWriter, r *http.Request) {
 				log.Fatal(err.Error())
 			}
 		} else {
-			stmt, err := db.Prepare("SELECT offers.insert_seller($1);")
+			err = db.QueryRow("SELECT offers.insert_seller($1);", sellerName).Scan(&sellerId)
 			if err != nil {
-				log.Fatal(err.Error())
-			}
-			defer stmt.Close()
-			err = stmt.QueryRow(sellerName).Scan(&sellerId)
-			if err != nil {
-				log.Fatal(err.Error())
+				releaseIdempotencyKey(db, "seller", idempotencyKey)
+				sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+				return
 			}
+			saveIdempotencyKey(db, "seller", idempotencyKey, sellerId)
 
 			requestResult := map[string]int{"seller_id": sellerId}
 			w.WriteHeader(http.StatusCreated)
@@ -395,34 +806,72 @@ func loadOffers(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err.Error())
 	}
 	if sellerExist {
-		var buf bytes.Buffer
-		file, _, err := r.FormFile("data")
+		sellerId, err := strconv.Atoi(params["id"])
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		defer file.Close()
-
-		_, err = io.Copy(&buf, file)
+		maxBytes, _, err := sellerLimits(db, sellerId)
 		if err != nil {
-			log.Fatal(err.Error())
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if r.ContentLength > maxBytes {
+			sendErrorMessage(w, requestTooLargeMessage(maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		sheet := r.URL.Query().Get("sheet")
+		if !validSheet(sheet) {
+			sendErrorMessage(w, "недопустимое значение sheet", http.StatusBadRequest)
+			return
 		}
+		body := &limitedBody{ReadCloser: r.Body, remaining: maxBytes}
+		r.Body = body
 
-		sellerId, err := strconv.Atoi(params["id"])
+		decoded, err := decodeRequestBody(r)
 		if err != nil {
-			log.Fatal(err.Error())
+			if body.exceeded {
+				sendErrorMessage(w, requestTooLargeMessage(maxBytes), http.StatusRequestEntityTooLarge)
+			} else if err == errUnsupportedEncoding {
+				sendErrorMessage(w, err.Error(), http.StatusUnsupportedMediaType)
+			} else {
+				sendErrorMessage(w, err.Error(), http.StatusBadRequest)
+			}
+			return
 		}
+		// распакованное тело запроса ограничено тем же размером, что и сжатое
+		unpacked := &limitedBody{ReadCloser: decoded, remaining: maxBytes}
+		r.Body = unpacked
 
-		var taskId int
-		stmt, err := db.Prepare("SELECT offers.insert_task($1);")
+		upload, err := saveFormFile(r, "data", maxBytes)
 		if err != nil {
-			log.Fatal(err.Error())
+			if body.exceeded || unpacked.exceeded || err == errFileTooLarge {
+				sendErrorMessage(w, requestTooLargeMessage(maxBytes), http.StatusRequestEntityTooLarge)
+			} else if decoded.failed {
+				sendErrorMessage(w, errInvalidEncoding.Error(), http.StatusBadRequest)
+			} else if err == errNoFormFile {
+				sendErrorMessage(w, "некорректные входные данные, ожидается файл в поле data", http.StatusBadRequest)
+			} else {
+				sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// ключ идемпотентности проверяется после получения файла, чтобы сравнить повторный запрос с исходным
+		idempotencyScope := "load:" + params["id"]
+		idempotencyKey, handled := checkIdempotencyKey(w, r, idempotencyScope, requestHash(upload.Hash, upload.Name, sheet),
+			"task_id", http.StatusOK)
+		if handled {
+			upload.Remove()
+			return
 		}
-		defer stmt.Close()
-		err = stmt.QueryRow(sellerId).Scan(&taskId)
+
+		taskId, err := startLoadTask(db, upload, sheet, sellerId, nil)
 		if err != nil {
-			log.Fatal(err.Error())
+			releaseIdempotencyKey(db, idempotencyScope, idempotencyKey)
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
 		}
-		go readExcelFile(db, &buf, sellerId, taskId)
+		saveIdempotencyKey(db, idempotencyScope, idempotencyKey, taskId)
 
 		taskMessage := map[string]int{"task_id": taskId}
 		w.WriteHeader(http.StatusOK)
@@ -440,65 +889,35 @@ func loadOffers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func searchOffers(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
-		return
-	}
-
-	var keyVal SearchOffer
-	err = json.Unmarshal(body, &keyVal)
-	if err != nil {
-		sendErrorMessage(w, "В процессе чтения входных данных произошла ошибка", http.StatusBadRequest)
-		return
-	}
-
-	query := `SELECT offer_id, offer_name, price, quantity, seller_id, seller_name
-              FROM offers.get_offers(_seller_id := $1, _offer_id := $2, _offer_name := $3, _ignore_register := $4);`
-	result, err := db.Query(query, keyVal.SellerId, keyVal.OfferId, keyVal.OfferName, keyVal.IgnoreRegister)
-	if err != nil {
-		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
-		return
-	}
-	offers := make([]OutputOffer, 0, 0)
-	for result.Next() {
-		var offer OutputOffer
-		err = result.Scan(&offer.OfferId, &offer.Name, &offer.Price, &offer.Quantity, &offer.SellerData.SellerId, &offer.SellerData.SellerName)
-		if err != nil {
-			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
-			return
-		}
-		offers = append(offers, offer)
-	}
-	offersData := map[string][]OutputOffer{"offers": offers}
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(offersData)
-	if err != nil {
-		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
-		return
-	}
-}
-
 func getTask(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var task Task
 
 	params := mux.Vars(r)
-	query := `SELECT task_id, start_date, finish_date, status, num_errors, num_created, num_updated, num_deleted, seller_id, seller_name 
+	query := `SELECT task_id, start_date, finish_date, status, num_errors, num_created, num_updated, num_deleted, seller_id, seller_name,
+                     source_url, file_size, error_message
               FROM offers.get_task($1);`
 	result, err := db.Query(query, params["id"])
 	if err != nil {
 		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
 		return
 	}
+	defer result.Close()
 	taskExists := result.Next()
 	if taskExists {
 		err = result.Scan(&task.TaskId, &task.StartDate, &task.FinishDate, &task.Status, &task.NumErrors,
 			              &task.NumCreated, &task.NumUpdated, &task.NumDeleted, &task.SellerData.SellerId,
-			              &task.SellerData.SellerName)
+			              &task.SellerData.SellerName, &task.SourceUrl, &task.FileSize, &task.ErrorMessage)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		task.Sheets, err = loadTaskSheets(db, task.TaskId)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		task.Files, err = loadTaskFiles(db, task.TaskId)
 		if err != nil {
 			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
 			return
@@ -540,7 +959,8 @@ func getAllTasks(w http.ResponseWriter, r *http.Request) {
 		}
 		offset = sql.NullInt32{Int32: int32(intOffset), Valid: true}
 	}
-	query := `SELECT task_id, start_date, finish_date, status, num_errors, num_created, num_updated, num_deleted, seller_id, seller_name 
+	query := `SELECT task_id, start_date, finish_date, status, num_errors, num_created, num_updated, num_deleted, seller_id, seller_name,
+                     source_url, file_size, error_message
               FROM offers.get_all_tasks($1, $2);`
 	result, err := db.Query(query, limit, offset)
 	if err != nil {
@@ -552,7 +972,7 @@ func getAllTasks(w http.ResponseWriter, r *http.Request) {
 		var task Task
 		err = result.Scan(&task.TaskId, &task.StartDate, &task.FinishDate, &task.Status, &task.NumErrors,
 			&task.NumCreated, &task.NumUpdated, &task.NumDeleted, &task.SellerData.SellerId,
-			&task.SellerData.SellerName)
+			&task.SellerData.SellerName, &task.SourceUrl, &task.FileSize, &task.ErrorMessage)
 		if err != nil {
 			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
 			return
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errInvalidPicture = errors.New("некорректный адрес изображения")
+
+// максимальное количество изображений одного товара
+const maxOfferPictures = 20
+
+// количество изображений, проверяемых за один проход
+const pictureCheckBatch = 100
+
+// период повторной проверки изображений, 0 -- проверка изображений отключена
+var pictureCheckInterval time.Duration
+
+var pictureClient = &http.Client{Timeout: 10 * time.Second, Transport: fetchTransport}
+
+// Проверить номер столбца с изображениями из настроек продавца: столбец не должен совпадать
+// с основными столбцами и столбцами атрибутов
+func validPictureColumn(column int, attributes []AttributeColumn) bool {
+	if column < firstAttributeColumn || column > 16384 {
+		return false
+	}
+	for _, attribute := range attributes {
+		if attribute.Column == column {
+			return false
+		}
+	}
+	return true
+}
+
+// Адреса изображений товара из ячейки, разделенные пробелами или запятыми. column -- номер
+// столбца, начиная с 1, 0 -- столбец не задан (nil, изображения товара не изменяются)
+func PicturesFromCells(cells []string, column int) ([]string, error) {
+	if column == 0 {
+		return nil, nil
+	}
+	pictures := strings.FieldsFunc(cellValue(cells, column-1), func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	})
+	if len(pictures) > maxOfferPictures {
+		return nil, errInvalidPicture
+	}
+	for _, picture := range pictures {
+		if len(picture) > 2048 || !validHttpUrl(picture) {
+			return nil, errInvalidPicture
+		}
+	}
+	return pictures, nil
+}
+
+// Изображение недоступно: сервер вернул ошибку или содержимое, не являющееся изображением
+func pictureBroken(client *http.Client, url string) bool {
+	response, err := client.Head(url)
+	if err == nil && (response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented) {
+		// сервер не поддерживает HEAD
+		response.Body.Close()
+		response, err = client.Get(url)
+	}
+	if err != nil {
+		return true
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return true
+	}
+	contentType := response.Header.Get("Content-Type")
+	return contentType != "" && !strings.HasPrefix(contentType, "image/")
+}
+
+// изображение товара для проверки
+type offerPicture struct {
+	SellerId int
+	OfferId  int
+	Position int
+	Url      string
+}
+
+// Проверить очередную порцию изображений, которые еще не проверялись или проверялись раньше
+// pictureCheckInterval назад. Вернет количество проверенных изображений
+func checkPictures(db *sql.DB, client *http.Client) (int, error) {
+	query := `SELECT seller_id, offer_id, position, url
+              FROM offers.OfferPicture
+              WHERE checked_at IS NULL OR checked_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+              ORDER BY checked_at NULLS FIRST
+              LIMIT $2;`
+	result, err := db.Query(query, int(pictureCheckInterval.Seconds()), pictureCheckBatch)
+	if err != nil {
+		return 0, err
+	}
+	var pictures []offerPicture
+	for result.Next() {
+		var picture offerPicture
+		if err = result.Scan(&picture.SellerId, &picture.OfferId, &picture.Position, &picture.Url); err != nil {
+			result.Close()
+			return 0, err
+		}
+		pictures = append(pictures, picture)
+	}
+	result.Close()
+	if err = result.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, picture := range pictures {
+		broken := pictureBroken(client, picture.Url)
+		// адрес мог измениться при загрузке товаров во время проверки
+		_, err = db.Exec(`UPDATE offers.OfferPicture SET broken = $5, checked_at = CURRENT_TIMESTAMP
+                          WHERE seller_id = $1 AND offer_id = $2 AND position = $3 AND url = $4;`,
+			picture.SellerId, picture.OfferId, picture.Position, picture.Url, broken)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pictures), nil
+}
+
+// Фоновая проверка изображений товаров, выполняется каждую минуту
+func runPictureChecker(db *sql.DB) {
+	for {
+		checked, err := checkPictures(db, pictureClient)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		if err != nil || checked < pictureCheckBatch {
+			time.Sleep(time.Minute)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errInvalidPrice = errors.New("некорректное значение цены")
+
+// максимальная цена в копейках, соответствует типу NUMERIC(12, 2)
+const maxPrice Price = 999999999999
+
+var pricePattern = regexp.MustCompile(`^\d+(\.\d+)?([eE][-+]?\d+)?$`)
+
+// Цена в копейках. В JSON цена в целых рублях выводится целым числом, как и раньше,
+// цена с копейками -- числом с двумя знаками после точки
+type Price int64
+
+// Цена в рублях без копеек
+func rubles(value int64) Price {
+	return Price(value * 100)
+}
+
+// Разобрать цену из строки. Допускаются точка или запятая в качестве десятичного разделителя
+// и пробелы между разрядами, значение округляется до копеек
+func parsePrice(value string) (Price, error) {
+	value = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\u00a0', '\u202f':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(value))
+	if strings.Count(value, ",") == 1 && !strings.Contains(value, ".") {
+		value = strings.Replace(value, ",", ".", 1)
+	}
+	if !pricePattern.MatchString(value) {
+		return 0, errInvalidPrice
+	}
+	if strings.ContainsAny(value, "eE") {
+		// экспоненциальная запись числа из ячейки таблицы
+		number, err := strconv.ParseFloat(value, 64)
+		kopecks := math.Round(number * 100)
+		if err != nil || kopecks > float64(maxPrice) {
+			return 0, errInvalidPrice
+		}
+		return Price(kopecks), nil
+	}
+
+	// десятичная запись округляется до копеек без перевода в число с плавающей точкой
+	integer, fraction := value, ""
+	if index := strings.IndexByte(value, '.'); index >= 0 {
+		integer, fraction = value[:index], value[index+1:]
+	}
+	whole, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil || whole > int64(maxPrice/100) {
+		return 0, errInvalidPrice
+	}
+	kopecks, _ := strconv.ParseInt((fraction + "00")[:2], 10, 64)
+	price := Price(whole*100 + kopecks)
+	if len(fraction) > 2 && fraction[2] >= '5' {
+		price++
+	}
+	if price > maxPrice {
+		return 0, errInvalidPrice
+	}
+	return price, nil
+}
+
+func (p Price) String() string {
+	sign, value := "", int64(p)
+	if value < 0 {
+		sign, value = "-", -value
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, value/100, value%100)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	if p%100 == 0 {
+		return []byte(strconv.FormatInt(int64(p/100), 10)), nil
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(data []byte) error {
+	price, err := parsePrice(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+	*p = price
+	return nil
+}
+
+// Значение для записи в столбец NUMERIC
+func (p Price) Value() (driver.Value, error) {
+	return p.String(), nil
+}
+
+// Чтение значения столбца NUMERIC
+func (p *Price) Scan(src interface{}) error {
+	var err error
+	switch value := src.(type) {
+	case []byte:
+		*p, err = parsePrice(string(value))
+	case string:
+		*p, err = parsePrice(value)
+	case int64:
+		*p = rubles(value)
+	case float64:
+		*p = Price(math.Round(value * 100))
+	default:
+		return fmt.Errorf("неподдерживаемый тип значения цены %T", src)
+	}
+	return err
+}
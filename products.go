@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// количество предложений, сопоставляемых с товарами за один проход
+const productMatchBatch = 1000
+
+// Товар, объединяющий предложения разных продавцов
+type Product struct {
+	ProductId   int     `json:"product_id"`
+	ProductName string  `json:"product_name"`
+	Barcode     *string `json:"barcode"`
+}
+
+func productFromParams(r *http.Request) (*Product, error) {
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, nil
+	}
+	return loadProduct(db, productId)
+}
+
+// Товар по идентификатору, nil -- товар не существует
+func loadProduct(db *sql.DB, productId int) (*Product, error) {
+	var product Product
+	err := db.QueryRow("SELECT product_id, product_name, barcode FROM offers.Product WHERE product_id = $1;",
+		productId).Scan(&product.ProductId, &product.ProductName, &product.Barcode)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// Фоновое сопоставление новых и измененных предложений с товарами
+func runProductMatcher(db *sql.DB) {
+	for {
+		var matched int
+		err := db.QueryRow("SELECT offers.match_offers($1);", productMatchBatch).Scan(&matched)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		if err != nil || matched < productMatchBatch {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// Предложения разных продавцов одного товара, по умолчанию -- по возрастанию цены в рублях.
+// Принимает те же параметры запроса, что и GET /offers/search
+func getProductOffers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	product, err := productFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if product == nil {
+		sendErrorMessage(w, "Товар с указанным ProductId не существует!", http.StatusBadRequest)
+		return
+	}
+	keyVal, err := searchFromQuery(r.URL.Query())
+	keyVal.ProductId = &product.ProductId
+	if keyVal.Sort == nil {
+		sort := "price"
+		keyVal.Sort = &sort
+	}
+	if !checkSearchOffer(w, &keyVal, err) {
+		return
+	}
+	sendSearchResult(w, keyVal, product)
+}
+
+// Товар, с которым сопоставлено предложение продавца
+func getOfferProduct(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, exists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+	offerId, err := strconv.Atoi(mux.Vars(r)["offer_id"])
+	if err != nil {
+		sendErrorMessage(w, "Отсутствует товар с указанным OfferId!", http.StatusBadRequest)
+		return
+	}
+	var productId *int
+	err = db.QueryRow("SELECT product_id FROM offers.Offer WHERE seller_id = $1 AND offer_id = $2;", sellerId, offerId).
+		Scan(&productId)
+	if err == sql.ErrNoRows {
+		sendErrorMessage(w, "Отсутствует товар с указанным OfferId!", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if productId == nil {
+		sendErrorMessage(w, "предложение еще не сопоставлено с товаром", http.StatusConflict)
+		return
+	}
+	product, err := loadProduct(db, *productId)
+	if err != nil || product == nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(product)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+}
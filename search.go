@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// структура для получения входных данных обработчика /offers/search
+type SearchOffer struct {
+	OfferId        *int    `json:"offer_id"`
+	OfferName      *string `json:"offer_name"`
+	SellerId       *int    `json:"seller_id"`
+	IgnoreRegister *bool   `json:"ignore_register"`
+	// способ поиска по offer_name: substring (подстрока), fulltext (полнотекстовый) или fuzzy (нечеткий)
+	Match *string `json:"match"`
+	// категория товара, включая ее подкатегории
+	CategoryId *int `json:"category_id"`
+	// значения дополнительных атрибутов, все значения должны совпадать
+	Attributes Attributes `json:"attributes"`
+	// несколько продавцов, товар должен принадлежать одному из них
+	SellerIds []int `json:"seller_ids"`
+	// диапазон цены в рублях по курсу валюты товара
+	MinPrice *Price `json:"min_price"`
+	MaxPrice *Price `json:"max_price"`
+	// минимальное количество товара, in_stock_only -- только товары с ненулевым количеством
+	MinQuantity *int  `json:"min_quantity"`
+	InStockOnly *bool `json:"in_stock_only"`
+	// порядок сортировки: name, price, quantity или seller, с префиксом "-" -- по убыванию,
+	// relevance -- по релевантности для полнотекстового и нечеткого поиска
+	Sort *string `json:"sort"`
+	// максимальное количество товаров в ответе и количество пропускаемых товаров
+	Limit  *int `json:"limit"`
+	Offset *int `json:"offset"`
+	// товар, с которым сопоставлено предложение
+	ProductId *int `json:"product_id"`
+	// фасеты, выводимые вместе с результатом: sellers, price, categories, attributes
+	Facets []string `json:"facets"`
+}
+
+// количество товаров в ответе поиска по умолчанию и максимальное
+const defaultSearchLimit = 100
+const maxSearchLimit = 1000
+
+// максимальное количество продавцов в фильтре seller_ids
+const maxSearchSellers = 100
+
+// сколько товаров после offset подсчитывается для total, дальше подсчет прекращается
+const maxSearchTotal = 10000
+
+// максимальное значение offset: более глубокие страницы требуют просмотра слишком многих товаров
+const maxSearchOffset = 10000
+
+// Результат поиска: страница товаров и общее количество найденных товаров
+type SearchResult struct {
+	// товар, для GET /products/{id}/offers
+	Product *Product      `json:"product,omitempty"`
+	Offers  []OutputOffer `json:"offers"`
+	Total   int64         `json:"total"`
+	// total не точный: найдено не меньше total товаров
+	TotalCapped bool          `json:"total_capped,omitempty"`
+	Facets      *SearchFacets `json:"facets,omitempty"`
+}
+
+// Ошибка во входных данных поиска, текст ошибки передается клиенту
+type searchError struct {
+	message string
+}
+
+func (e searchError) Error() string {
+	return e.message
+}
+
+var errSearchInput = searchError{"В процессе чтения входных данных произошла ошибка"}
+
+func invalidSearchParameter(name string) error {
+	return searchError{"некорректное значение параметра " + name}
+}
+
+// Целочисленный параметр запроса, nil -- параметр не указан
+func queryInt(values url.Values, name string) (*int, error) {
+	if _, ok := values[name]; !ok {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(values.Get(name))
+	if err != nil {
+		return nil, invalidSearchParameter(name)
+	}
+	return &value, nil
+}
+
+// Логический параметр запроса (true/false), nil -- параметр не указан
+func queryBool(values url.Values, name string) (*bool, error) {
+	if _, ok := values[name]; !ok {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(values.Get(name))
+	if err != nil {
+		return nil, invalidSearchParameter(name)
+	}
+	return &value, nil
+}
+
+// Цена из параметра запроса, nil -- параметр не указан
+func queryPrice(values url.Values, name string) (*Price, error) {
+	if _, ok := values[name]; !ok {
+		return nil, nil
+	}
+	value, err := parsePrice(values.Get(name))
+	if err != nil {
+		return nil, invalidSearchParameter(name)
+	}
+	return &value, nil
+}
+
+// Список идентификаторов из параметра запроса: через запятую (seller_ids=1,2) или повторением параметра
+func queryIntList(values url.Values, name string) ([]int, error) {
+	var list []int
+	for _, value := range values[name] {
+		for _, item := range strings.Split(value, ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil {
+				return nil, invalidSearchParameter(name)
+			}
+			list = append(list, number)
+		}
+	}
+	return list, nil
+}
+
+// Условия поиска из параметров запроса GET /offers/search
+func searchFromQuery(values url.Values) (SearchOffer, error) {
+	var search SearchOffer
+	var err error
+	if search.OfferId, err = queryInt(values, "offer_id"); err != nil {
+		return search, err
+	}
+	if search.SellerId, err = queryInt(values, "seller_id"); err != nil {
+		return search, err
+	}
+	if search.CategoryId, err = queryInt(values, "category_id"); err != nil {
+		return search, err
+	}
+	if search.ProductId, err = queryInt(values, "product_id"); err != nil {
+		return search, err
+	}
+	if search.IgnoreRegister, err = queryBool(values, "ignore_register"); err != nil {
+		return search, err
+	}
+	if search.SellerIds, err = queryIntList(values, "seller_ids"); err != nil {
+		return search, err
+	}
+	if search.MinPrice, err = queryPrice(values, "min_price"); err != nil {
+		return search, err
+	}
+	if search.MaxPrice, err = queryPrice(values, "max_price"); err != nil {
+		return search, err
+	}
+	if search.MinQuantity, err = queryInt(values, "min_quantity"); err != nil {
+		return search, err
+	}
+	if search.InStockOnly, err = queryBool(values, "in_stock_only"); err != nil {
+		return search, err
+	}
+	if search.Limit, err = queryInt(values, "limit"); err != nil {
+		return search, err
+	}
+	if search.Offset, err = queryInt(values, "offset"); err != nil {
+		return search, err
+	}
+	if _, ok := values["offer_name"]; ok {
+		offerName := values.Get("offer_name")
+		search.OfferName = &offerName
+	}
+	search.Facets = queryFacets(values["facets"])
+	if _, ok := values["match"]; ok {
+		match := values.Get("match")
+		search.Match = &match
+	}
+	if _, ok := values["sort"]; ok {
+		sort := values.Get("sort")
+		search.Sort = &sort
+	}
+	return search, nil
+}
+
+// Прочитать условия поиска: для POST -- из JSON в теле запроса, для GET -- из параметров запроса.
+// GET запрос без параметров может передавать условия в теле запроса, как в прежних версиях API
+func readSearchOffer(r *http.Request) (SearchOffer, error) {
+	var search SearchOffer
+	if r.Method == "GET" && len(r.URL.Query()) > 0 {
+		return searchFromQuery(r.URL.Query())
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return search, err
+	}
+	if r.Method == "GET" && len(bytes.TrimSpace(body)) == 0 {
+		return search, nil
+	}
+	if err = json.Unmarshal(body, &search); err != nil {
+		return search, errSearchInput
+	}
+	return search, nil
+}
+
+// Проверить фильтры по продавцам, цене и количеству
+func validSearchFilters(search *SearchOffer) error {
+	if len(search.SellerIds) > maxSearchSellers {
+		return searchError{"недопустимое значение seller_ids"}
+	}
+	if len(search.SellerIds) == 0 {
+		search.SellerIds = nil
+	}
+	if search.MinPrice != nil && search.MaxPrice != nil && *search.MinPrice > *search.MaxPrice {
+		return searchError{"недопустимое значение max_price"}
+	}
+	if search.MinQuantity != nil && *search.MinQuantity < 0 {
+		return searchError{"недопустимое значение min_quantity"}
+	}
+	if !validFacets(search.Facets) {
+		return searchError{"недопустимое значение facets"}
+	}
+	if search.Match == nil {
+		match := "substring"
+		search.Match = &match
+	}
+	switch *search.Match {
+	case "substring", "fulltext", "fuzzy":
+	default:
+		return searchError{"недопустимое значение match"}
+	}
+	return nil
+}
+
+// Результат поиска упорядочивается по релевантности: полнотекстовый или нечеткий поиск по названию
+func (s SearchOffer) ranked() bool {
+	return s.OfferName != nil && s.Match != nil && *s.Match != "substring"
+}
+
+// Значения фильтров для offers.get_offers и offers.count_offers, в порядке параметров $1-$13
+func (s SearchOffer) filterArgs() []interface{} {
+	return []interface{}{s.SellerId, s.OfferId, s.OfferName, s.IgnoreRegister, s.CategoryId, s.Attributes,
+		pq.Array(s.SellerIds), s.MinPrice, s.MaxPrice, s.MinQuantity, s.InStockOnly, s.Match, s.ProductId}
+}
+
+// Проверить параметры сортировки и постраничного вывода, не указанные параметры получают
+// значения по умолчанию
+func validSearchPage(search *SearchOffer) error {
+	if search.Sort == nil {
+		sort := "name"
+		if search.ranked() {
+			sort = "relevance"
+		}
+		search.Sort = &sort
+	}
+	switch strings.TrimPrefix(*search.Sort, "-") {
+	case "name", "price", "quantity", "seller":
+	case "relevance":
+		if *search.Sort != "relevance" || !search.ranked() {
+			return searchError{"недопустимое значение sort"}
+		}
+	default:
+		return searchError{"недопустимое значение sort"}
+	}
+	if search.Limit == nil {
+		limit := defaultSearchLimit
+		search.Limit = &limit
+	}
+	if *search.Limit < 1 || *search.Limit > maxSearchLimit {
+		return searchError{"недопустимое значение limit"}
+	}
+	if search.Offset == nil {
+		offset := 0
+		search.Offset = &offset
+	}
+	if *search.Offset < 0 || *search.Offset > maxSearchOffset {
+		return searchError{"недопустимое значение offset"}
+	}
+	return nil
+}
+
+func searchOffers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	keyVal, err := readSearchOffer(r)
+	if !checkSearchOffer(w, &keyVal, err) {
+		return
+	}
+	sendSearchResult(w, keyVal, nil)
+}
+
+// Проверить условия поиска, прочитанные с ошибкой err, и заполнить значения по умолчанию.
+// Вернет false, если ответ клиенту уже отправлен
+func checkSearchOffer(w http.ResponseWriter, keyVal *SearchOffer, err error) bool {
+	if err == nil {
+		err = validSearchFilters(keyVal)
+	}
+	if err == nil {
+		err = validSearchPage(keyVal)
+	}
+	var inputErr searchError
+	if errors.As(err, &inputErr) {
+		sendErrorMessage(w, inputErr.message, http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	if !validAttributesFilter(keyVal.Attributes) {
+		sendErrorMessage(w, "недопустимое значение attributes", http.StatusBadRequest)
+		return false
+	}
+	if len(keyVal.Attributes) == 0 {
+		keyVal.Attributes = nil
+	}
+	return true
+}
+
+// Выполнить поиск и отправить клиенту результат. product -- товар, предложения которого ищутся
+func sendSearchResult(w http.ResponseWriter, keyVal SearchOffer, product *Product) {
+	query := `SELECT offer_id, offer_name, price, quantity, currency, price_rub, old_price, discount_to, category_id,
+                     attributes, pictures, highlight, relevance, seller_id, seller_name
+              FROM offers.get_offers(_seller_id := $1, _offer_id := $2, _offer_name := $3, _ignore_register := $4,
+                                     _category_id := $5, _attributes := $6, _seller_ids := $7, _min_price := $8,
+                                     _max_price := $9, _min_quantity := $10, _in_stock_only := $11,
+                                     _match := $12, _product_id := $13, _sort := $14, _limit := $15,
+                                     _offset := $16);`
+	result, err := db.Query(query, append(keyVal.filterArgs(), keyVal.Sort, keyVal.Limit, keyVal.Offset)...)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer result.Close()
+	searchResult := SearchResult{Product: product, Offers: make([]OutputOffer, 0, 0)}
+	for result.Next() {
+		var offer OutputOffer
+		err = result.Scan(&offer.OfferId, &offer.Name, &offer.Price, &offer.Quantity, &offer.Currency, &offer.PriceRub,
+			&offer.OldPrice, &offer.DiscountTo, &offer.CategoryId, &offer.Attributes, pq.Array(&offer.Pictures),
+			&offer.Highlight, &offer.Relevance, &offer.SellerData.SellerId, &offer.SellerData.SellerName)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		searchResult.Offers = append(searchResult.Offers, offer)
+	}
+
+	// общее количество нужно только если результат не поместился на страницу
+	searchResult.Total = int64(*keyVal.Offset + len(searchResult.Offers))
+	if len(searchResult.Offers) == *keyVal.Limit || (len(searchResult.Offers) == 0 && *keyVal.Offset > 0) {
+		query = `SELECT offers.count_offers(_seller_id := $1, _offer_id := $2, _offer_name := $3, _ignore_register := $4,
+                                            _category_id := $5, _attributes := $6, _seller_ids := $7,
+                                            _min_price := $8, _max_price := $9, _min_quantity := $10,
+                                            _in_stock_only := $11, _match := $12, _product_id := $13,
+                                            _max_count := $14);`
+		maxCount := int64(*keyVal.Offset + maxSearchTotal)
+		args := append(keyVal.filterArgs(), maxCount)
+		err = db.QueryRow(query, args...).Scan(&searchResult.Total)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		searchResult.TotalCapped = searchResult.Total == maxCount
+	}
+	if len(keyVal.Facets) > 0 {
+		query = `SELECT offers.offer_facets(_facets := $1, _seller_id := $2, _offer_id := $3, _offer_name := $4,
+                                            _ignore_register := $5, _category_id := $6, _attributes := $7,
+                                            _seller_ids := $8, _min_price := $9, _max_price := $10,
+                                            _min_quantity := $11, _in_stock_only := $12, _match := $13,
+                                            _product_id := $14);`
+		searchResult.Facets = &SearchFacets{}
+		args := append([]interface{}{pq.Array(keyVal.Facets)}, keyVal.filterArgs()...)
+		err = db.QueryRow(query, args...).Scan(searchResult.Facets)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(searchResult)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+}
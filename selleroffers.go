@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidOffer = errors.New("некорректные данные товара")
+var errOfferExists = errors.New("Товар с указанным OfferId уже существует!")
+
+// Товар продавца в том виде, в котором он хранится в offers.Offer: цена без учета периода скидки,
+// изображения -- все, включая недоступные
+type SellerOffer struct {
+	OfferId      int        `json:"offer_id"`
+	Name         string     `json:"offer_name"`
+	Price        Price      `json:"price"`
+	Quantity     int        `json:"quantity"`
+	Currency     string     `json:"currency"`
+	OldPrice     *Price     `json:"old_price"`
+	DiscountFrom *time.Time `json:"discount_from"`
+	DiscountTo   *time.Time `json:"discount_to"`
+	CategoryId   *int       `json:"category_id"`
+	Attributes   Attributes `json:"attributes"`
+	Pictures     []string   `json:"pictures"`
+	// товар, с которым сопоставлено предложение, null -- еще не сопоставлено
+	ProductId *int `json:"product_id"`
+}
+
+// Входные данные POST, PUT и PATCH /sellers/{id}/offers. Отсутствующие поля -- пустые ячейки строки файла,
+// pictures равный null -- изображения товара не изменяются
+type offerInput struct {
+	OfferId      *int       `json:"offer_id"`
+	Name         *string    `json:"offer_name"`
+	Price        *Price     `json:"price"`
+	Quantity     *int       `json:"quantity"`
+	Currency     *string    `json:"currency"`
+	OldPrice     *Price     `json:"old_price"`
+	DiscountFrom *time.Time `json:"discount_from"`
+	DiscountTo   *time.Time `json:"discount_to"`
+	CategoryId   *int       `json:"category_id"`
+	Attributes   Attributes `json:"attributes"`
+	Pictures     []string   `json:"pictures"`
+}
+
+// Входные данные для PATCH: текущие значения товара
+func (o SellerOffer) input() offerInput {
+	return offerInput{OfferId: &o.OfferId, Name: &o.Name, Price: &o.Price, Quantity: &o.Quantity,
+		Currency: &o.Currency, OldPrice: o.OldPrice, DiscountFrom: o.DiscountFrom, DiscountTo: o.DiscountTo,
+		CategoryId: o.CategoryId, Attributes: o.Attributes, Pictures: o.Pictures}
+}
+
+// Строка файла с данными товара и настройки продавца для ее обработки, чтобы к товару применялись
+// те же проверки, что и при загрузке файла
+func (i offerInput) row(options importOptions) ([]string, importOptions, error) {
+	width := firstAttributeColumn - 1
+	for _, column := range options.Attributes {
+		if column.Column > width {
+			width = column.Column
+		}
+	}
+	// изображения передаются в столбце из настроек продавца или в первом свободном столбце
+	if i.Pictures == nil {
+		options.PictureColumn = 0
+	} else if options.PictureColumn == 0 {
+		options.PictureColumn = width + 1
+	}
+	if options.PictureColumn > width {
+		width = options.PictureColumn
+	}
+
+	cells := make([]string, width)
+	if i.OfferId != nil {
+		cells[0] = strconv.Itoa(*i.OfferId)
+	}
+	if i.Name != nil {
+		cells[1] = *i.Name
+	}
+	if i.Price != nil {
+		cells[2] = i.Price.String()
+	}
+	if i.Quantity != nil {
+		cells[3] = strconv.Itoa(*i.Quantity)
+	}
+	cells[4] = "true"
+	if i.Currency != nil {
+		cells[5] = *i.Currency
+	}
+	if i.OldPrice != nil {
+		cells[6] = i.OldPrice.String()
+	}
+	if i.DiscountFrom != nil {
+		cells[7] = i.DiscountFrom.UTC().Format("2006-01-02T15:04:05")
+	}
+	if i.DiscountTo != nil {
+		cells[8] = i.DiscountTo.UTC().Format("2006-01-02T15:04:05")
+	}
+	if i.CategoryId != nil {
+		cells[9] = strconv.Itoa(*i.CategoryId)
+	}
+	for name, value := range i.Attributes {
+		column := -1
+		for _, attribute := range options.Attributes {
+			if attribute.Name == name {
+				column = attribute.Column
+			}
+		}
+		if column < 0 {
+			return nil, options, errInvalidAttribute
+		}
+		switch value := value.(type) {
+		case nil:
+			// null в PATCH удаляет атрибут
+		case string:
+			cells[column-1] = value
+		case float64:
+			cells[column-1] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			cells[column-1] = strconv.FormatBool(value)
+		default:
+			return nil, options, errInvalidAttribute
+		}
+	}
+	if options.PictureColumn > 0 {
+		cells[options.PictureColumn-1] = strings.Join(i.Pictures, " ")
+	}
+	return cells, options, nil
+}
+
+// Проверить данные товара по правилам загрузки файлов
+func offerFromInput(db *sql.DB, input offerInput, sellerId int) (*ExcelOffer, error) {
+	options, err := sellerImportOptions(db, sellerId)
+	if err != nil {
+		return nil, err
+	}
+	cells, options, err := input.row(options)
+	if err != nil {
+		return nil, errInvalidOffer
+	}
+	offer, err := offerFromRow(cells, sellerId, options)
+	if err != nil {
+		return nil, errInvalidOffer
+	}
+	return offer, nil
+}
+
+// Товар продавца, nil -- товар не существует
+func loadSellerOffer(db *sql.DB, sellerId int, offerId int) (*SellerOffer, error) {
+	var offer SellerOffer
+	query := `SELECT offer_id, offer_name, price, quantity, currency, old_price, discount_from, discount_to,
+                     category_id, attributes,
+                     ARRAY(SELECT url
+                           FROM offers.OfferPicture AS OP
+                           WHERE OP.seller_id = O.seller_id
+                             AND OP.offer_id = O.offer_id
+                           ORDER BY position),
+                     product_id
+              FROM offers.Offer AS O
+              WHERE seller_id = $1 AND offer_id = $2;`
+	err := db.QueryRow(query, sellerId, offerId).Scan(&offer.OfferId, &offer.Name, &offer.Price, &offer.Quantity,
+		&offer.Currency, &offer.OldPrice, &offer.DiscountFrom, &offer.DiscountTo, &offer.CategoryId, &offer.Attributes,
+		pq.Array(&offer.Pictures), &offer.ProductId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &offer, nil
+}
+
+// Продавец и товар из url. Вернет false, если ответ клиенту уже отправлен
+func sellerOfferFromParams(w http.ResponseWriter, r *http.Request) (int, *SellerOffer, bool) {
+	sellerId, exists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if !exists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	offerId, err := strconv.Atoi(mux.Vars(r)["offer_id"])
+	if err != nil {
+		sendErrorMessage(w, "Отсутствует товар с указанным OfferId!", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	offer, err := loadSellerOffer(db, sellerId, offerId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if offer == nil {
+		sendErrorMessage(w, "Отсутствует товар с указанным OfferId!", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	return sellerId, offer, true
+}
+
+// Прочитать данные товара из тела запроса поверх значений input. Вернет false, если ответ клиенту уже отправлен
+func readOfferInput(w http.ResponseWriter, r *http.Request, input *offerInput) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	err = json.Unmarshal(body, input)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Проверить товар и сохранить его так же, как строку загружаемого файла: изменение выполняется
+// задачей продавца и отражается в /tasks. create -- товар только создается, существующий не изменяется.
+// Вернет false, если ответ клиенту уже отправлен
+func saveSellerOffer(w http.ResponseWriter, sellerId int, input offerInput, create bool) bool {
+	offer, err := offerFromInput(db, input, sellerId)
+	if err == errInvalidOffer {
+		sendErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	if offer.CategoryId != nil {
+		exists, err := categoryExists(db, *offer.CategoryId)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return false
+		}
+		if !exists {
+			sendErrorMessage(w, "Категория с указанным CategoryId не существует!", http.StatusBadRequest)
+			return false
+		}
+	}
+	return applySellerOffer(w, *offer, create)
+}
+
+// Записать товар (available = false -- удалить) в рамках новой задачи продавца.
+// Вернет false, если ответ клиенту уже отправлен
+func applySellerOffer(w http.ResponseWriter, offer ExcelOffer, create bool) bool {
+	taskId, err := insertTask(db, offer.SellerId, "Выполняется", nil, nil, nil, "")
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	err = writeSellerOffer(taskId, offer, create)
+	if err == errOfferExists {
+		// товар с тем же offer_id создан параллельным запросом
+		if err = taskSetError(db, taskId, errOfferExists.Error()); err != nil {
+			log.Println(err.Error())
+		}
+		sendErrorMessage(w, errOfferExists.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		if err = taskSetError(db, taskId, "ошибка при сохранении товаров"); err != nil {
+			log.Println(err.Error())
+		}
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// Записать товар в транзакции задачи. Если create и товар не был создан, вернет errOfferExists
+func writeSellerOffer(taskId int, offer ExcelOffer, create bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	writer, err := newJsonOffersWriter(tx)
+	if err != nil {
+		return err
+	}
+	if err = writer.Write(offer); err != nil {
+		return err
+	}
+	counters, err := writer.Finish()
+	if err != nil {
+		return err
+	}
+	if create && counters.Created == 0 {
+		return errOfferExists
+	}
+	if err = finishTask(tx, taskId, counters); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func sendSellerOffer(w http.ResponseWriter, sellerId int, offerId int, statusCode int) {
+	offer, err := loadSellerOffer(db, sellerId, offerId)
+	if err != nil || offer == nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	err = json.NewEncoder(w).Encode(offer)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func getSellerOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, offer, ok := sellerOfferFromParams(w, r)
+	if !ok {
+		return
+	}
+	sendSellerOffer(w, sellerId, offer.OfferId, http.StatusOK)
+}
+
+func createSellerOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, exists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+	var input offerInput
+	if !readOfferInput(w, r, &input) {
+		return
+	}
+	if input.OfferId == nil {
+		sendErrorMessage(w, errInvalidOffer.Error(), http.StatusBadRequest)
+		return
+	}
+	existing, err := loadSellerOffer(db, sellerId, *input.OfferId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		sendErrorMessage(w, errOfferExists.Error(), http.StatusConflict)
+		return
+	}
+	if !saveSellerOffer(w, sellerId, input, true) {
+		return
+	}
+	sendSellerOffer(w, sellerId, *input.OfferId, http.StatusCreated)
+}
+
+// Заменить все поля товара, pictures равный null оставляет изображения без изменений
+func replaceSellerOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, offer, ok := sellerOfferFromParams(w, r)
+	if !ok {
+		return
+	}
+	var input offerInput
+	if !readOfferInput(w, r, &input) {
+		return
+	}
+	updateSellerOffer(w, sellerId, offer.OfferId, input)
+}
+
+// Изменить только переданные поля товара
+func patchSellerOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, offer, ok := sellerOfferFromParams(w, r)
+	if !ok {
+		return
+	}
+	input := offer.input()
+	// атрибуты, удаленные из настроек продавца, не переносятся в измененный товар,
+	// неизвестные атрибуты отклоняются, только если их передал клиент
+	options, err := sellerImportOptions(db, sellerId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	input.Attributes = Attributes{}
+	for _, column := range options.Attributes {
+		if value, ok := offer.Attributes[column.Name]; ok {
+			input.Attributes[column.Name] = value
+		}
+	}
+	if !readOfferInput(w, r, &input) {
+		return
+	}
+	updateSellerOffer(w, sellerId, offer.OfferId, input)
+}
+
+func updateSellerOffer(w http.ResponseWriter, sellerId int, offerId int, input offerInput) {
+	// идентификатор товара задается в url и не изменяется
+	if input.OfferId != nil && *input.OfferId != offerId {
+		sendErrorMessage(w, errInvalidOffer.Error(), http.StatusBadRequest)
+		return
+	}
+	input.OfferId = &offerId
+	if !saveSellerOffer(w, sellerId, input, false) {
+		return
+	}
+	sendSellerOffer(w, sellerId, offerId, http.StatusOK)
+}
+
+func deleteSellerOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, offer, ok := sellerOfferFromParams(w, r)
+	if !ok {
+		return
+	}
+	deleted := ExcelOffer{Offer: Offer{OfferId: offer.OfferId, Name: offer.Name, Price: offer.Price,
+		Quantity: offer.Quantity, Currency: offer.Currency}, SellerId: sellerId, Available: false}
+	if !applySellerOffer(w, deleted, false) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// общие ограничения на размер запроса (файла) и количество строк в файле,
+// могут быть переопределены в настройках продавца
+var maxUploadBytes int64 = 50 << 20
+var maxRows = 1000000
+
+// Настройки продавца, значение null -- используется общее значение
+type SellerSettings struct {
+	SellerId       int    `json:"seller_id"`
+	MaxUploadBytes *int64 `json:"max_upload_bytes"`
+	MaxRows        *int   `json:"max_rows"`
+	// лист для загрузки по умолчанию: название или номер листа вида "#2", null -- все листы
+	Sheet *string `json:"sheet"`
+	// валюта цен по умолчанию для строк без валюты, null -- RUB
+	Currency *string `json:"currency"`
+	// столбцы файла с дополнительными атрибутами товаров, null -- атрибуты не загружаются
+	Attributes []AttributeColumn `json:"attributes"`
+	// номер столбца файла с адресами изображений товаров, null -- изображения не загружаются
+	PictureColumn *int `json:"picture_column"`
+}
+
+// тело запроса, чтение которого ограничено заданным количеством байт
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// лимит исчерпан, проверяем, остались ли в теле непрочитанные данные
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n == 0 {
+			return 0, err
+		}
+		b.exceeded = true
+		return 0, errFileTooLarge
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func requestTooLargeMessage(maxBytes int64) string {
+	return fmt.Sprintf("размер запроса превышает допустимый (%d байт)", maxBytes)
+}
+
+// Получить настройки продавца
+func loadSellerSettings(db *sql.DB, sellerId int) (*SellerSettings, error) {
+	settings := SellerSettings{SellerId: sellerId}
+	var attributes []byte
+	err := db.QueryRow(`SELECT max_upload_bytes, max_rows, sheet, currency, attributes, picture_column
+                         FROM offers.SellerSettings WHERE seller_id = $1;`, sellerId).
+		Scan(&settings.MaxUploadBytes, &settings.MaxRows, &settings.Sheet, &settings.Currency, &attributes,
+			&settings.PictureColumn)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if attributes != nil {
+		if err = json.Unmarshal(attributes, &settings.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return &settings, nil
+}
+
+// Ограничения на размер файла и количество строк с учетом настроек продавца. Настройки продавца
+// могут только уменьшить общие ограничения
+func sellerLimits(db *sql.DB, sellerId int) (int64, int, error) {
+	settings, err := loadSellerSettings(db, sellerId)
+	if err != nil {
+		return 0, 0, err
+	}
+	sellerMaxBytes, sellerMaxRows := maxUploadBytes, maxRows
+	if settings.MaxUploadBytes != nil && *settings.MaxUploadBytes < sellerMaxBytes {
+		sellerMaxBytes = *settings.MaxUploadBytes
+	}
+	if settings.MaxRows != nil && *settings.MaxRows < sellerMaxRows {
+		sellerMaxRows = *settings.MaxRows
+	}
+	return sellerMaxBytes, sellerMaxRows, nil
+}
+
+func getSellerSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+	settings, err := loadSellerSettings(db, sellerId)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(settings)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func setSellerSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sellerId, sellerExists, err := sellerFromParams(r)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !sellerExists {
+		sendErrorMessage(w, "Продавец с указанным SellerId не существует!", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	var settings SellerSettings
+	err = json.Unmarshal(body, &settings)
+	if err != nil {
+		sendErrorMessage(w, "некорректные входные данные, на входе ожидается JSON", http.StatusBadRequest)
+		return
+	}
+	settings.SellerId = sellerId
+	if settings.MaxUploadBytes != nil && (*settings.MaxUploadBytes <= 0 || *settings.MaxUploadBytes > maxUploadBytes) {
+		sendErrorMessage(w, "недопустимое значение max_upload_bytes", http.StatusBadRequest)
+		return
+	}
+	if settings.MaxRows != nil && (*settings.MaxRows <= 0 || *settings.MaxRows > maxRows) {
+		sendErrorMessage(w, "недопустимое значение max_rows", http.StatusBadRequest)
+		return
+	}
+
+	if settings.Sheet != nil {
+		sheet := strings.TrimSpace(*settings.Sheet)
+		if !validSheet(sheet) {
+			sendErrorMessage(w, "недопустимое значение sheet", http.StatusBadRequest)
+			return
+		}
+		settings.Sheet = &sheet
+		if sheet == "" {
+			settings.Sheet = nil
+		}
+	}
+
+	if settings.Currency != nil {
+		currency, err := parseCurrency(*settings.Currency)
+		if err != nil {
+			sendErrorMessage(w, "недопустимое значение currency", http.StatusBadRequest)
+			return
+		}
+		settings.Currency = &currency
+	}
+
+	var attributes *string
+	if settings.Attributes != nil {
+		if !validAttributeColumns(settings.Attributes) {
+			sendErrorMessage(w, "недопустимое значение attributes", http.StatusBadRequest)
+			return
+		}
+		data, err := json.Marshal(settings.Attributes)
+		if err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		value := string(data)
+		attributes = &value
+	}
+	if settings.PictureColumn != nil && !validPictureColumn(*settings.PictureColumn, settings.Attributes) {
+		sendErrorMessage(w, "недопустимое значение picture_column", http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT offers.set_seller_settings($1, $2, $3, $4, $5, $6, $7);"
+	_, err = db.Exec(query, sellerId, settings.MaxUploadBytes, settings.MaxRows, settings.Sheet, settings.Currency,
+		attributes, settings.PictureColumn)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(settings)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+	}
+}
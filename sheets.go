@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+var errSheetNotFound = errors.New("в файле нет листа, указанного в параметре sheet")
+
+// Листы книги, из которых были загружены товары, и пропущенные листы
+type SheetReport struct {
+	Read    []string `json:"read"`
+	Skipped []string `json:"skipped"`
+}
+
+// Выбор листов книги по названию или номеру листа в виде "#2" (начиная с 1), пустое значение -- все листы.
+// Номер отличается от названия префиксом, чтобы лист с названием "2" не путался со вторым листом.
+// Читатели табличных файлов вызывают include для каждого листа в порядке их следования
+type sheetSelection struct {
+	sheet  string
+	index  int
+	report SheetReport
+}
+
+func newSheetSelection(sheet string) *sheetSelection {
+	return &sheetSelection{sheet: strings.TrimSpace(sheet), report: SheetReport{Read: []string{}, Skipped: []string{}}}
+}
+
+// Проверить, нужно ли читать очередной лист, и учесть его в отчете
+func (s *sheetSelection) include(name string) bool {
+	if s == nil {
+		return true
+	}
+	s.index++
+	selected := s.sheet == "" || strings.EqualFold(strings.TrimSpace(name), s.sheet)
+	if strings.HasPrefix(s.sheet, "#") {
+		if number, err := strconv.Atoi(s.sheet[1:]); err == nil && number > 0 {
+			selected = number == s.index
+		}
+	}
+	if selected {
+		s.report.Read = append(s.report.Read, name)
+	} else {
+		s.report.Skipped = append(s.report.Skipped, name)
+	}
+	return selected
+}
+
+// Указанный лист отсутствует в файле
+func (s *sheetSelection) missing() bool {
+	return s != nil && s.index > 0 && len(s.report.Read) == 0
+}
+
+// Отчет о прочитанных листах, nil -- формат файла не содержит листов (csv)
+func (s *sheetSelection) Report() *SheetReport {
+	if s == nil || s.index == 0 {
+		return nil
+	}
+	return &s.report
+}
+
+// Проверить длину названия листа
+func validSheet(sheet string) bool {
+	return len([]rune(strings.TrimSpace(sheet))) <= 255
+}
+
+// Лист для загрузки: значение из запроса, если оно не задано -- значение из настроек продавца
+func sellerSheet(db *sql.DB, sellerId int, requested string) (string, error) {
+	if strings.TrimSpace(requested) != "" {
+		return strings.TrimSpace(requested), nil
+	}
+	settings, err := loadSellerSettings(db, sellerId)
+	if err != nil || settings.Sheet == nil {
+		return "", err
+	}
+	return *settings.Sheet, nil
+}
+
+// Сохранить отчет о листах для задачи
+func setTaskSheets(tx *sql.Tx, taskId int, report *SheetReport) error {
+	if report == nil {
+		return nil
+	}
+	_, err := tx.Exec("UPDATE offers.Task SET sheets_read = $2, sheets_skipped = $3 WHERE task_id = $1;",
+		taskId, pq.Array(report.Read), pq.Array(report.Skipped))
+	return err
+}
+
+// Отчет о листах для задачи
+func loadTaskSheets(db *sql.DB, taskId int) (*SheetReport, error) {
+	var read, skipped pq.StringArray
+	err := db.QueryRow("SELECT sheets_read, sheets_skipped FROM offers.Task WHERE task_id = $1;", taskId).
+		Scan(&read, &skipped)
+	if err != nil || read == nil {
+		return nil, err
+	}
+	return &SheetReport{Read: read, Skipped: skipped}, nil
+}
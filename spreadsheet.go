@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// форматы загружаемых файлов
+const (
+	formatXlsx = "xlsx"
+	formatXls  = "xls"
+	formatOds  = "ods"
+	formatCsv  = "csv"
+	formatZip  = "zip"
+	formatYml  = "yml"
+)
+
+// Определить формат файла. Табличные форматы, архивы и yml каталоги определяются по содержимому файла,
+// csv файлы -- по расширению в имени файла
+func detectFileFormat(filePath string, fileName string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, len(oleSignature))
+	_, err = io.ReadFull(file, signature)
+	file.Close()
+	if err == nil && bytes.Equal(signature, oleSignature) {
+		return formatXls, nil
+	}
+
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		if strings.EqualFold(path.Ext(fileName), ".csv") {
+			return formatCsv, nil
+		}
+		if isYmlFile(filePath) {
+			return formatYml, nil
+		}
+		return "", errInvalidXlsx
+	}
+	defer archive.Close()
+	switch {
+	case isOdsArchive(archive):
+		return formatOds, nil
+	case findZipFile(archive, "[Content_Types].xml") != nil || findZipFile(archive, "xl/workbook.xml") != nil:
+		return formatXlsx, nil
+	}
+	return formatZip, nil
+}
+
+// Открыть табличный файл заданного формата для потокового чтения строк выбранных листов.
+// selection равный nil -- читаются все листы, для csv файлов выбор листа не применяется
+func openRows(filePath string, format string, selection *sheetSelection) (rowSource, error) {
+	switch format {
+	case formatXls:
+		rows, err := openXlsRows(filePath)
+		if err != nil {
+			return nil, err
+		}
+		rows.selection = selection
+		return rows, nil
+	case formatOds:
+		rows, err := openOdsRows(filePath)
+		if err != nil {
+			return nil, err
+		}
+		rows.selection = selection
+		return rows, nil
+	case formatCsv:
+		return openCsvRows(filePath)
+	case formatYml:
+		return openYmlRows(filePath)
+	case formatXlsx:
+		rows, err := openXlsxRows(filePath)
+		if err != nil {
+			return nil, err
+		}
+		rows.selection = selection
+		return rows, nil
+	}
+	return nil, errInvalidXlsx
+}
+
+// Ошибка вызвана некорректным содержимым файла
+func invalidFileFormat(err error) bool {
+	return err == errInvalidXlsx || err == errInvalidXls || err == errInvalidOds || err == errInvalidCsv ||
+		err == errInvalidGzip || err == errInvalidYml || err == errSheetNotFound
+}
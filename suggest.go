@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// количество подсказок по умолчанию и максимальное
+const defaultSuggestLimit = 10
+const maxSuggestLimit = 50
+
+// Подсказка для строки поиска: название товара и количество товаров с таким названием
+type Suggestion struct {
+	OfferName string `json:"offer_name"`
+	Count     int    `json:"count"`
+}
+
+// Параметры запроса GET /offers/suggest
+type suggestQuery struct {
+	Query    string
+	SellerId *int
+	Limit    int
+}
+
+func readSuggestQuery(r *http.Request) (suggestQuery, error) {
+	values := r.URL.Query()
+	suggest := suggestQuery{Query: strings.TrimSpace(values.Get("q")), Limit: defaultSuggestLimit}
+	if suggest.Query == "" || len([]rune(suggest.Query)) > 255 {
+		return suggest, searchError{"недопустимое значение q"}
+	}
+	var err error
+	if suggest.SellerId, err = queryInt(values, "seller_id"); err != nil {
+		return suggest, err
+	}
+	limit, err := queryInt(values, "limit")
+	if err != nil {
+		return suggest, err
+	}
+	if limit != nil {
+		if *limit < 1 || *limit > maxSuggestLimit {
+			return suggest, searchError{"недопустимое значение limit"}
+		}
+		suggest.Limit = *limit
+	}
+	return suggest, nil
+}
+
+func suggestOffers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	suggest, err := readSuggestQuery(r)
+	var inputErr searchError
+	if errors.As(err, &inputErr) {
+		sendErrorMessage(w, inputErr.message, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	query := `SELECT offer_name, offers_count FROM offers.suggest_offers(_query := $1, _seller_id := $2, _limit := $3);`
+	result, err := db.Query(query, suggest.Query, suggest.SellerId, suggest.Limit)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer result.Close()
+	suggestions := make([]Suggestion, 0, suggest.Limit)
+	for result.Next() {
+		var suggestion Suggestion
+		if err = result.Scan(&suggestion.OfferName, &suggestion.Count); err != nil {
+			sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	suggestionsData := map[string][]Suggestion{"suggestions": suggestions}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(suggestionsData)
+	if err != nil {
+		sendErrorMessage(w, "внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+var errNoFormFile = errors.New("в запросе отсутствует файл")
+
+// Загруженный файл, сохраненный во временный файл на диске
+type uploadedFile struct {
+	Path string
+	Name string
+	Size int64
+	Hash string
+}
+
+// Удалить временный файл
+func (f *uploadedFile) Remove() {
+	if err := os.Remove(f.Path); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Сохранить данные во временный файл, не более limit байт, попутно вычисляя sha256 хеш содержимого
+func saveUpload(r io.Reader, name string, limit int64) (*uploadedFile, error) {
+	tmp, err := ioutil.TempFile("", "offers-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, limit+1))
+	if err == nil && size > limit {
+		err = errFileTooLarge
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &uploadedFile{
+		Path: tmp.Name(),
+		Name: name,
+		Size: size,
+		Hash: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Сохранить файл из поля multipart формы, читая тело запроса потоком
+func saveFormFile(r *http.Request, field string, limit int64) (*uploadedFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errNoFormFile
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errNoFormFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			defer part.Close()
+			return saveUpload(part, part.FileName(), limit)
+		}
+		part.Close()
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var errInvalidXls = errors.New("некорректный формат xls файла")
+
+// сигнатура составного документа OLE2, в котором хранятся xls файлы
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+const (
+	oleEndOfChain = 0xFFFFFFFE
+	oleMaxRegular = 0xFFFFFFFA
+)
+
+// Последовательность секторов потока составного документа, доступная для чтения по смещению
+type sectorChain struct {
+	reader     io.ReaderAt
+	sectors    []uint32
+	sectorSize int64
+	base       int64
+}
+
+func (c *sectorChain) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		index := off / c.sectorSize
+		if index >= int64(len(c.sectors)) {
+			return total, io.EOF
+		}
+		inSector := off % c.sectorSize
+		n := int64(len(p))
+		if n > c.sectorSize-inSector {
+			n = c.sectorSize - inSector
+		}
+		read, err := c.reader.ReadAt(p[:n], c.base+int64(c.sectors[index])*c.sectorSize+inSector)
+		total += read
+		if err != nil && !(err == io.EOF && int64(read) == n) {
+			return total, errInvalidXls
+		}
+		p = p[n:]
+		off += n
+	}
+	return total, nil
+}
+
+// Список секторов цепочки, начинающейся с сектора start
+func followChain(table []uint32, start uint32) ([]uint32, error) {
+	var sectors []uint32
+	for sector := start; sector != oleEndOfChain; sector = table[sector] {
+		if sector > oleMaxRegular || int(sector) >= len(table) || len(sectors) >= len(table) {
+			return nil, errInvalidXls
+		}
+		sectors = append(sectors, sector)
+	}
+	return sectors, nil
+}
+
+func readUint32s(reader io.ReaderAt, offset int64, count int) ([]uint32, error) {
+	data := make([]byte, count*4)
+	if _, err := reader.ReadAt(data, offset); err != nil {
+		return nil, errInvalidXls
+	}
+	values := make([]uint32, count)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return values, nil
+}
+
+// Найти в составном документе поток книги Excel и вернуть его для последовательного чтения
+func openWorkbookStream(file *os.File) (io.Reader, error) {
+	header := make([]byte, 512)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != string(oleSignature) {
+		return nil, errInvalidXls
+	}
+	sectorShift := binary.LittleEndian.Uint16(header[0x1E:])
+	if sectorShift != 9 && sectorShift != 12 {
+		return nil, errInvalidXls
+	}
+	sectorSize := int64(1) << sectorShift
+	perSector := int(sectorSize / 4)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// количество секторов в файле ограничивает длину цепочек, в том числе зацикленных
+	fileSectors := info.Size() / sectorSize
+
+	// таблица размещения секторов: первые 109 ее секторов перечислены в заголовке,
+	// остальные -- в цепочке дополнительных секторов
+	fatCount := int(binary.LittleEndian.Uint32(header[0x2C:]))
+	fatSectors, _ := readUint32s(file, 0x4C, 109)
+	next := binary.LittleEndian.Uint32(header[0x44:])
+	difatSectors := int64(0)
+	for difatCount := binary.LittleEndian.Uint32(header[0x48:]); difatCount > 0 && next <= oleMaxRegular; difatCount-- {
+		if difatSectors++; difatSectors > fileSectors {
+			return nil, errInvalidXls
+		}
+		entries, err := readUint32s(file, (int64(next)+1)*sectorSize, perSector)
+		if err != nil {
+			return nil, err
+		}
+		fatSectors = append(fatSectors, entries[:perSector-1]...)
+		next = entries[perSector-1]
+	}
+	if fatCount > len(fatSectors) {
+		return nil, errInvalidXls
+	}
+	var fat []uint32
+	for _, sector := range fatSectors[:fatCount] {
+		entries, err := readUint32s(file, (int64(sector)+1)*sectorSize, perSector)
+		if err != nil {
+			return nil, err
+		}
+		fat = append(fat, entries...)
+	}
+
+	directorySectors, err := followChain(fat, binary.LittleEndian.Uint32(header[0x30:]))
+	if err != nil {
+		return nil, err
+	}
+	directory := &sectorChain{reader: file, sectors: directorySectors, sectorSize: sectorSize, base: sectorSize}
+	var root, workbook []byte
+	entry := make([]byte, 128)
+	for offset := int64(0); offset < int64(len(directorySectors))*sectorSize; offset += 128 {
+		if _, err := directory.ReadAt(entry, offset); err != nil {
+			return nil, err
+		}
+		nameLength := int(binary.LittleEndian.Uint16(entry[64:]))
+		if nameLength < 2 || nameLength > 64 {
+			continue
+		}
+		name := make([]uint16, nameLength/2-1)
+		for i := range name {
+			name[i] = binary.LittleEndian.Uint16(entry[i*2:])
+		}
+		switch entryType, entryName := entry[66], string(utf16.Decode(name)); {
+		case entryType == 5 && root == nil:
+			root = append([]byte(nil), entry...)
+		case entryType == 2 && strings.EqualFold(entryName, "Workbook"):
+			workbook = append([]byte(nil), entry...)
+		}
+	}
+	if root == nil || workbook == nil {
+		return nil, errInvalidXls
+	}
+
+	start := binary.LittleEndian.Uint32(workbook[116:])
+	size := int64(binary.LittleEndian.Uint32(workbook[120:]))
+	if size >= int64(binary.LittleEndian.Uint32(header[0x38:])) {
+		sectors, err := followChain(fat, start)
+		if err != nil {
+			return nil, err
+		}
+		chain := &sectorChain{reader: file, sectors: sectors, sectorSize: sectorSize, base: sectorSize}
+		return io.NewSectionReader(chain, 0, size), nil
+	}
+
+	// небольшие потоки хранятся в секторах по 64 байта внутри потока корневого элемента
+	rootSectors, err := followChain(fat, binary.LittleEndian.Uint32(root[116:]))
+	if err != nil {
+		return nil, err
+	}
+	miniStream := &sectorChain{reader: file, sectors: rootSectors, sectorSize: sectorSize, base: sectorSize}
+	miniFatSectors, err := followChain(fat, binary.LittleEndian.Uint32(header[0x3C:]))
+	if err != nil {
+		return nil, err
+	}
+	var miniFat []uint32
+	for _, sector := range miniFatSectors {
+		entries, err := readUint32s(file, (int64(sector)+1)*sectorSize, perSector)
+		if err != nil {
+			return nil, err
+		}
+		miniFat = append(miniFat, entries...)
+	}
+	sectors, err := followChain(miniFat, start)
+	if err != nil {
+		return nil, err
+	}
+	chain := &sectorChain{reader: miniStream, sectors: sectors, sectorSize: 64, base: 0}
+	return io.NewSectionReader(chain, 0, size), nil
+}
+
+// Последовательное чтение данных записи, продолженной записями CONTINUE
+type continuedRecord struct {
+	segments [][]byte
+	segment  int
+	offset   int
+}
+
+func (c *continuedRecord) read(n int) ([]byte, error) {
+	var data []byte
+	for n > 0 {
+		if c.segment >= len(c.segments) {
+			return nil, errInvalidXls
+		}
+		current := c.segments[c.segment][c.offset:]
+		if len(current) == 0 {
+			c.segment, c.offset = c.segment+1, 0
+			continue
+		}
+		if len(current) > n {
+			current = current[:n]
+		}
+		data = append(data, current...)
+		c.offset += len(current)
+		n -= len(current)
+	}
+	return data, nil
+}
+
+// Прочитать символы строки. Если строка прерывается записью CONTINUE,
+// продолжение начинается с байта флагов, задающего кодировку оставшихся символов
+func (c *continuedRecord) readChars(count int, wide bool) (string, error) {
+	var text []uint16
+	for count > 0 {
+		if c.segment >= len(c.segments) {
+			return "", errInvalidXls
+		}
+		if c.offset == len(c.segments[c.segment]) {
+			c.segment, c.offset = c.segment+1, 0
+			flags, err := c.read(1)
+			if err != nil {
+				return "", err
+			}
+			wide = flags[0]&1 != 0
+			continue
+		}
+		charSize := 1
+		if wide {
+			charSize = 2
+		}
+		available := (len(c.segments[c.segment]) - c.offset) / charSize
+		if available == 0 {
+			return "", errInvalidXls
+		}
+		if available > count {
+			available = count
+		}
+		data, _ := c.read(available * charSize)
+		for i := 0; i < available; i++ {
+			if wide {
+				text = append(text, binary.LittleEndian.Uint16(data[i*2:]))
+			} else {
+				text = append(text, uint16(data[i]))
+			}
+		}
+		count -= available
+	}
+	return string(utf16.Decode(text)), nil
+}
+
+// Прочитать строку в формате BIFF8: длина (1 или 2 байта), флаги, символы и дополнительные данные
+func (c *continuedRecord) readString(lengthSize int) (string, error) {
+	header, err := c.read(lengthSize + 1)
+	if err != nil {
+		return "", err
+	}
+	count := int(header[0])
+	if lengthSize == 2 {
+		count = int(binary.LittleEndian.Uint16(header))
+	}
+	flags := header[lengthSize]
+	runs, extended := 0, 0
+	if flags&8 != 0 {
+		data, err := c.read(2)
+		if err != nil {
+			return "", err
+		}
+		runs = int(binary.LittleEndian.Uint16(data))
+	}
+	if flags&4 != 0 {
+		data, err := c.read(4)
+		if err != nil {
+			return "", err
+		}
+		extended = int(binary.LittleEndian.Uint32(data))
+	}
+	text, err := c.readChars(count, flags&1 != 0)
+	if err != nil {
+		return "", err
+	}
+	if _, err = c.read(runs*4 + extended); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+func parseXlsString(data []byte, lengthSize int) (string, error) {
+	record := continuedRecord{segments: [][]byte{data}}
+	return record.readString(lengthSize)
+}
+
+// Значение числа в сжатом формате RK
+func rkValue(rk uint32) float64 {
+	var value float64
+	if rk&2 != 0 {
+		value = float64(int32(rk) >> 2)
+	} else {
+		value = math.Float64frombits(uint64(rk&^3) << 32)
+	}
+	if rk&1 != 0 {
+		value /= 100
+	}
+	return value
+}
+
+func formatXlsNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+var xlsErrorCodes = map[byte]string{
+	0x00: "#NULL!", 0x07: "#DIV/0!", 0x0F: "#VALUE!", 0x17: "#REF!", 0x1D: "#NAME?", 0x24: "#NUM!", 0x2A: "#N/A",
+}
+
+func xlsBoolErr(value byte, isError bool) string {
+	if isError {
+		return xlsErrorCodes[value]
+	}
+	if value != 0 {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+const (
+	xlsRecordFormula    = 0x0006
+	xlsRecordEOF        = 0x000A
+	xlsRecordContinue   = 0x003C
+	xlsRecordBoundSheet = 0x0085
+	xlsRecordMulRk      = 0x00BD
+	xlsRecordRString    = 0x00D6
+	xlsRecordSST        = 0x00FC
+	xlsRecordLabelSST   = 0x00FD
+	xlsRecordNumber     = 0x0203
+	xlsRecordLabel      = 0x0204
+	xlsRecordBoolErr    = 0x0205
+	xlsRecordString     = 0x0207
+	xlsRecordRk         = 0x027E
+	xlsRecordBOF        = 0x0809
+)
+
+// Потоковое чтение строк xls файла (BIFF8, Excel 97 и новее): записи потока книги читаются
+// последовательно, в памяти хранится только таблица общих строк и текущая строка
+type xlsRows struct {
+	file          *os.File
+	stream        *bufio.Reader
+	position      int64
+	header        [4]byte
+	data          []byte
+	sharedStrings []string
+	sheets        map[int64]string
+	selection     *sheetSelection
+	depth         int
+	inSheet       bool
+	row           []string
+	rowIndex      int
+	formulaColumn int
+	rowNumber     int
+	pending       []string
+	pendingNumber int
+	done          bool
+}
+
+// Открыть xls файл для потокового чтения
+func openXlsRows(filePath string) (*xlsRows, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := openWorkbookStream(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rows := &xlsRows{file: file, stream: bufio.NewReader(stream), sheets: make(map[int64]string), rowIndex: -1, formulaColumn: -1}
+	if err = rows.readGlobals(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Прочитать следующую запись потока, вернет ее тип и смещение в потоке
+func (x *xlsRows) readRecord() (uint16, int64, error) {
+	position := x.position
+	if _, err := io.ReadFull(x.stream, x.header[:]); err != nil {
+		// поток книги может быть дополнен нулями до размера сектора
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, position, io.EOF
+		}
+		return 0, position, errInvalidXls
+	}
+	length := int(binary.LittleEndian.Uint16(x.header[2:]))
+	if cap(x.data) < length {
+		x.data = make([]byte, length)
+	}
+	x.data = x.data[:length]
+	if _, err := io.ReadFull(x.stream, x.data); err != nil {
+		return 0, position, errInvalidXls
+	}
+	x.position += int64(4 + length)
+	return binary.LittleEndian.Uint16(x.header[:]), position, nil
+}
+
+// Прочитать общую часть книги: список листов и таблицу общих строк
+func (x *xlsRows) readGlobals() error {
+	recordType, _, err := x.readRecord()
+	if err != nil || recordType != xlsRecordBOF || len(x.data) < 4 ||
+		binary.LittleEndian.Uint16(x.data) != 0x0600 || binary.LittleEndian.Uint16(x.data[2:]) != 0x0005 {
+		return errInvalidXls
+	}
+	var sst *continuedRecord
+	for {
+		recordType, _, err = x.readRecord()
+		if err != nil {
+			return errInvalidXls
+		}
+		if sst != nil {
+			if recordType == xlsRecordContinue {
+				sst.segments = append(sst.segments, append([]byte(nil), x.data...))
+				continue
+			}
+			if err = x.readSharedStrings(sst); err != nil {
+				return err
+			}
+			sst = nil
+		}
+		switch recordType {
+		case xlsRecordEOF:
+			return nil
+		case xlsRecordBoundSheet:
+			// учитываются только листы с данными, диаграммы и макросы пропускаются
+			if len(x.data) < 8 || x.data[5] != 0 {
+				continue
+			}
+			name, err := parseXlsString(x.data[6:], 1)
+			if err != nil {
+				return err
+			}
+			x.sheets[int64(binary.LittleEndian.Uint32(x.data))] = name
+		case xlsRecordSST:
+			if len(x.data) < 8 {
+				return errInvalidXls
+			}
+			sst = &continuedRecord{segments: [][]byte{append([]byte(nil), x.data[8:]...)}}
+			// количество строк из заголовка используется только как оценка размера таблицы
+			count := binary.LittleEndian.Uint32(x.data[4:])
+			if count > 1<<16 {
+				count = 1 << 16
+			}
+			x.sharedStrings = make([]string, 0, count)
+		}
+	}
+}
+
+func (x *xlsRows) readSharedStrings(sst *continuedRecord) error {
+	for sst.segment < len(sst.segments)-1 || sst.offset < len(sst.segments[len(sst.segments)-1]) {
+		text, err := sst.readString(2)
+		if err != nil {
+			return err
+		}
+		x.sharedStrings = append(x.sharedStrings, text)
+	}
+	return nil
+}
+
+// Следующая строка листа. Пропущенные в файле строки возвращаются как пустые
+func (x *xlsRows) Next() ([]string, error) {
+	for {
+		if x.pending != nil {
+			x.rowNumber++
+			if x.rowNumber < x.pendingNumber {
+				return []string{}, nil
+			}
+			row := x.pending
+			x.pending = nil
+			return row, nil
+		}
+		if x.done {
+			return nil, io.EOF
+		}
+		if err := x.readNext(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Обработать очередную запись потока
+func (x *xlsRows) readNext() error {
+	recordType, position, err := x.readRecord()
+	if err == io.EOF {
+		x.done = true
+		x.finishRow()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch recordType {
+	case xlsRecordBOF:
+		x.depth++
+		if name, ok := x.sheets[position]; ok && x.depth == 1 && x.selection.include(name) {
+			x.inSheet = true
+			x.rowNumber = 0
+		}
+		return nil
+	case xlsRecordEOF:
+		x.depth--
+		if x.depth == 0 && x.inSheet {
+			x.inSheet = false
+			x.finishRow()
+		}
+		return nil
+	}
+	if !x.inSheet || x.depth != 1 {
+		return nil
+	}
+
+	data := x.data
+	switch recordType {
+	case xlsRecordNumber, xlsRecordRk, xlsRecordMulRk, xlsRecordLabelSST, xlsRecordLabel, xlsRecordRString,
+		xlsRecordBoolErr, xlsRecordFormula:
+		if len(data) < 6 {
+			return errInvalidXls
+		}
+	}
+	switch recordType {
+	case xlsRecordNumber:
+		if len(data) < 14 {
+			return errInvalidXls
+		}
+		value := math.Float64frombits(binary.LittleEndian.Uint64(data[6:]))
+		x.setCell(data, formatXlsNumber(value))
+	case xlsRecordRk:
+		if len(data) < 10 {
+			return errInvalidXls
+		}
+		x.setCell(data, formatXlsNumber(rkValue(binary.LittleEndian.Uint32(data[6:]))))
+	case xlsRecordMulRk:
+		row := int(binary.LittleEndian.Uint16(data))
+		column := int(binary.LittleEndian.Uint16(data[2:]))
+		for offset := 4; offset+6 <= len(data)-2; offset += 6 {
+			x.setValue(row, column, formatXlsNumber(rkValue(binary.LittleEndian.Uint32(data[offset+2:]))))
+			column++
+		}
+	case xlsRecordLabelSST:
+		if len(data) < 10 {
+			return errInvalidXls
+		}
+		index := int(binary.LittleEndian.Uint32(data[6:]))
+		if index >= len(x.sharedStrings) {
+			return errInvalidXls
+		}
+		x.setCell(data, x.sharedStrings[index])
+	case xlsRecordLabel, xlsRecordRString:
+		text, err := parseXlsString(data[6:], 2)
+		if err != nil {
+			return err
+		}
+		x.setCell(data, text)
+	case xlsRecordBoolErr:
+		if len(data) < 8 {
+			return errInvalidXls
+		}
+		x.setCell(data, xlsBoolErr(data[6], data[7] != 0))
+	case xlsRecordFormula:
+		if len(data) < 14 {
+			return errInvalidXls
+		}
+		result := data[6:14]
+		if result[6] != 0xFF || result[7] != 0xFF {
+			x.setCell(data, formatXlsNumber(math.Float64frombits(binary.LittleEndian.Uint64(result))))
+			return nil
+		}
+		switch result[0] {
+		case 0:
+			// строковый результат формулы хранится в следующей записи STRING
+			x.setCell(data, "")
+			x.formulaColumn = int(binary.LittleEndian.Uint16(data[2:]))
+		case 1, 2:
+			x.setCell(data, xlsBoolErr(result[2], result[0] == 2))
+		}
+	case xlsRecordString:
+		text, err := parseXlsString(data, 2)
+		if err != nil {
+			return err
+		}
+		if x.formulaColumn >= 0 && x.formulaColumn < len(x.row) {
+			x.row[x.formulaColumn] = text
+		}
+		x.formulaColumn = -1
+	}
+	return nil
+}
+
+func (x *xlsRows) setCell(data []byte, value string) {
+	x.setValue(int(binary.LittleEndian.Uint16(data)), int(binary.LittleEndian.Uint16(data[2:])), value)
+}
+
+// Записать значение ячейки. Переход к другой строке завершает текущую
+func (x *xlsRows) setValue(row int, column int, value string) {
+	x.formulaColumn = -1
+	if row != x.rowIndex {
+		x.finishRow()
+		x.rowIndex = row
+	}
+	for len(x.row) <= column {
+		x.row = append(x.row, "")
+	}
+	x.row[column] = value
+}
+
+func (x *xlsRows) finishRow() {
+	if x.row != nil {
+		x.pending, x.pendingNumber = x.row, x.rowIndex+1
+	}
+	x.row, x.rowIndex = nil, -1
+}
+
+func (x *xlsRows) Close() error {
+	return x.file.Close()
+}
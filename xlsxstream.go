@@ -0,0 +1,422 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var errInvalidXlsx = errors.New("некорректный формат xlsx файла")
+var errXlsxPartTooLarge = errors.New("размер распакованной части xlsx файла превышает допустимый")
+
+// максимальное количество столбцов листа (XFD)
+const xlsxMaxColumns = 16384
+
+// ограничение распакованного размера служебных частей xlsx файла, которые разбираются в памяти
+// целиком (workbook, таблица общих строк). Размер листов ограничен maxArchiveBytes
+var maxXlsxXmlBytes int64 = 64 << 20
+
+// Потоковое чтение строк xlsx файла: листы читаются последовательно, xml листа
+// разбирается по мере чтения, в памяти хранится только таблица общих строк и текущая строка
+type xlsxRows struct {
+	archive       *zip.ReadCloser
+	sharedStrings []string
+	sheets        []*zip.File
+	sheetNames    []string
+	sheetIndex    int
+	selection     *sheetSelection
+	sheetReader   io.ReadCloser
+	decoder       *xml.Decoder
+	rowNumber     int
+	pending       []string
+	pendingNumber int
+}
+
+// Открыть xlsx файл для потокового чтения
+func openXlsxRows(filePath string) (*xlsxRows, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, errInvalidXlsx
+	}
+	rows := &xlsxRows{archive: archive}
+	if err = rows.readWorkbook(); err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+func findZipFile(archive *zip.ReadCloser, name string) *zip.File {
+	for _, file := range archive.File {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+// Чтение части xlsx файла с ограничением распакованного размера и степени сжатия
+type xlsxPartReader struct {
+	reader    io.Reader
+	closer    io.Closer
+	remaining int64
+	err       error
+}
+
+func (r *xlsxPartReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *xlsxPartReader) Close() error {
+	return r.closer.Close()
+}
+
+// Открыть часть xlsx файла. Если распакованный размер превышает maxBytes, чтение вернет tooLarge
+func openXlsxPart(file *zip.File, maxBytes int64, tooLarge error) (io.ReadCloser, error) {
+	if int64(file.UncompressedSize64) > maxBytes {
+		return nil, tooLarge
+	}
+	if file.UncompressedSize64 > compressionRatioGrace &&
+		int64(file.UncompressedSize64) > int64(file.CompressedSize64)*maxCompressionRatio {
+		return nil, errArchiveRatio
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, errInvalidXlsx
+	}
+	return &xlsxPartReader{reader: &ratioReader{reader: reader, compressed: int64(file.CompressedSize64)},
+		closer: reader, remaining: maxBytes, err: tooLarge}, nil
+}
+
+// Ошибка чтения xlsx файла: превышение ограничений возвращается как есть, остальные -- errInvalidXlsx
+func xlsxError(err error) error {
+	if err == errXlsxPartTooLarge || err == errArchiveTooLarge || err == errArchiveRatio {
+		return err
+	}
+	return errInvalidXlsx
+}
+
+// Разбор xml файла из архива целиком, используется для небольших служебных файлов
+func decodeZipFile(file *zip.File, v interface{}) error {
+	reader, err := openXlsxPart(file, maxXlsxXmlBytes, errXlsxPartTooLarge)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return xml.NewDecoder(reader).Decode(v)
+}
+
+// Определить порядок листов и прочитать таблицу общих строк
+func (x *xlsxRows) readWorkbook() error {
+	workbookFile := findZipFile(x.archive, "xl/workbook.xml")
+	relsFile := findZipFile(x.archive, "xl/_rels/workbook.xml.rels")
+	if workbookFile == nil || relsFile == nil {
+		return errInvalidXlsx
+	}
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			Id   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decodeZipFile(workbookFile, &workbook); err != nil {
+		return xlsxError(err)
+	}
+	var rels struct {
+		Relationships []struct {
+			Id     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decodeZipFile(relsFile, &rels); err != nil {
+		return xlsxError(err)
+	}
+
+	targets := make(map[string]string)
+	sharedStringsPath := "xl/sharedStrings.xml"
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		targets[rel.Id] = target
+		if strings.HasSuffix(rel.Type, "/sharedStrings") {
+			sharedStringsPath = target
+		}
+	}
+	for _, sheet := range workbook.Sheets {
+		file := findZipFile(x.archive, targets[sheet.Id])
+		if file == nil {
+			return errInvalidXlsx
+		}
+		x.sheets = append(x.sheets, file)
+		x.sheetNames = append(x.sheetNames, sheet.Name)
+	}
+
+	if file := findZipFile(x.archive, sharedStringsPath); file != nil {
+		return x.readSharedStrings(file)
+	}
+	return nil
+}
+
+// Таблица общих строк: элементы si, текст которых может быть разбит на несколько фрагментов t
+func (x *xlsxRows) readSharedStrings(file *zip.File) error {
+	reader, err := openXlsxPart(file, maxXlsxXmlBytes, errXlsxPartTooLarge)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := xml.NewDecoder(reader)
+	var text strings.Builder
+	phonetic := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return xlsxError(err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				text.Reset()
+			case "rPh":
+				phonetic = true
+			case "t":
+				if !phonetic {
+					value, err := readElementText(decoder)
+					if err != nil {
+						return xlsxError(err)
+					}
+					text.WriteString(value)
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				x.sharedStrings = append(x.sharedStrings, text.String())
+			case "rPh":
+				phonetic = false
+			}
+		}
+	}
+}
+
+// Прочитать текст элемента до его закрывающего тега
+func readElementText(decoder *xml.Decoder) (string, error) {
+	var text strings.Builder
+	depth := 1
+	for depth > 0 {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return text.String(), nil
+}
+
+// Номер столбца по ссылке на ячейку, например "C5" -- 2. Для столбцов правее XFD вернет xlsxMaxColumns
+func columnIndex(ref string) int {
+	index := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A'+1)
+		if index > xlsxMaxColumns {
+			return xlsxMaxColumns
+		}
+	}
+	return index - 1
+}
+
+// Следующая строка листа. Пропущенные в файле строки возвращаются как пустые
+func (x *xlsxRows) Next() ([]string, error) {
+	for {
+		if x.pending != nil {
+			x.rowNumber++
+			if x.rowNumber < x.pendingNumber {
+				return []string{}, nil
+			}
+			row := x.pending
+			x.pending = nil
+			return row, nil
+		}
+		if x.decoder == nil {
+			for x.sheetIndex < len(x.sheets) && !x.selection.include(x.sheetNames[x.sheetIndex]) {
+				x.sheetIndex++
+			}
+			if x.sheetIndex >= len(x.sheets) {
+				return nil, io.EOF
+			}
+			reader, err := openXlsxPart(x.sheets[x.sheetIndex], maxArchiveBytes, errArchiveTooLarge)
+			if err != nil {
+				return nil, err
+			}
+			x.sheetIndex++
+			x.sheetReader = reader
+			x.decoder = xml.NewDecoder(reader)
+			x.rowNumber = 0
+		}
+
+		token, err := x.decoder.Token()
+		if err == io.EOF {
+			x.closeSheet()
+			continue
+		}
+		if err != nil {
+			return nil, xlsxError(err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "row" {
+			number := x.rowNumber + 1
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "r" {
+					if number, err = strconv.Atoi(attr.Value); err != nil {
+						return nil, errInvalidXlsx
+					}
+				}
+			}
+			row, err := x.readRow()
+			if err != nil {
+				return nil, xlsxError(err)
+			}
+			x.pending, x.pendingNumber = row, number
+		}
+	}
+}
+
+// Прочитать ячейки строки до закрывающего тега row
+func (x *xlsxRows) readRow() ([]string, error) {
+	row := []string{}
+	for {
+		token, err := x.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				return row, nil
+			}
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				continue
+			}
+			index, cellType := len(row), ""
+			for _, attr := range t.Attr {
+				switch attr.Name.Local {
+				case "r":
+					index = columnIndex(attr.Value)
+				case "t":
+					cellType = attr.Value
+				}
+			}
+			value, err := x.readCell(cellType)
+			if err != nil {
+				return nil, err
+			}
+			if index < 0 {
+				index = len(row)
+			}
+			if index >= xlsxMaxColumns {
+				return nil, errInvalidXlsx
+			}
+			for len(row) <= index {
+				row = append(row, "")
+			}
+			row[index] = value
+		}
+	}
+}
+
+// Прочитать значение ячейки до закрывающего тега c
+func (x *xlsxRows) readCell(cellType string) (string, error) {
+	var value, inline strings.Builder
+	for {
+		token, err := x.decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.EndElement:
+			if t.Name.Local == "c" {
+				return x.cellValue(cellType, value.String(), inline.String())
+			}
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "v":
+				text, err := readElementText(x.decoder)
+				if err != nil {
+					return "", err
+				}
+				value.WriteString(text)
+			case "t":
+				text, err := readElementText(x.decoder)
+				if err != nil {
+					return "", err
+				}
+				inline.WriteString(text)
+			case "f":
+				if _, err := readElementText(x.decoder); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+}
+
+// Значение ячейки с учетом ее типа
+func (x *xlsxRows) cellValue(cellType string, value string, inline string) (string, error) {
+	switch cellType {
+	case "s":
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 || index >= len(x.sharedStrings) {
+			return "", errInvalidXlsx
+		}
+		return x.sharedStrings[index], nil
+	case "inlineStr":
+		return inline, nil
+	case "b":
+		if value == "1" {
+			return "TRUE", nil
+		} else if value == "0" {
+			return "FALSE", nil
+		}
+	}
+	return value, nil
+}
+
+func (x *xlsxRows) closeSheet() {
+	if x.sheetReader != nil {
+		x.sheetReader.Close()
+	}
+	x.sheetReader = nil
+	x.decoder = nil
+}
+
+func (x *xlsxRows) Close() error {
+	x.closeSheet()
+	return x.archive.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var errInvalidYml = errors.New("некорректный формат yml файла")
+
+// номер столбца (начиная с 1), в который читатель yml помещает адреса изображений товара
+const ymlPictureColumn = 11
+
+// Товар из yml файла (Яндекс.Маркет), читаются только поля, которые загружаются в offers.Offer
+type ymlOffer struct {
+	Id         string   `xml:"id,attr"`
+	Available  string   `xml:"available,attr"`
+	Name       string   `xml:"name"`
+	Price      string   `xml:"price"`
+	OldPrice   string   `xml:"oldprice"`
+	CurrencyId string   `xml:"currencyId"`
+	Count      string   `xml:"count"`
+	Pictures   []string `xml:"picture"`
+}
+
+// Потоковое чтение товаров (элементов offer) yml файла в кодировке UTF-8. Каждый товар
+// возвращается строкой в формате табличных файлов, адреса изображений -- в столбце ymlPictureColumn
+type ymlRows struct {
+	file    *os.File
+	decoder *xml.Decoder
+}
+
+// Проверить, что файл является yml каталогом: xml документ с корневым элементом yml_catalog
+func isYmlFile(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(file, head)
+	head = bytes.TrimLeft(bytes.TrimPrefix(head[:n], []byte{0xEF, 0xBB, 0xBF}), " \t\r\n")
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<yml_catalog"))
+}
+
+func openYmlRows(filePath string) (*ymlRows, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &ymlRows{file: file, decoder: xml.NewDecoder(bufio.NewReader(file))}, nil
+}
+
+// Следующий товар файла
+func (y *ymlRows) Next() ([]string, error) {
+	for {
+		token, err := y.decoder.Token()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, errInvalidYml
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "offer" {
+			continue
+		}
+		var offer ymlOffer
+		if err = y.decoder.DecodeElement(&offer, &element); err != nil {
+			return nil, errInvalidYml
+		}
+		return offer.cells(), nil
+	}
+}
+
+// Строка товара в формате табличных файлов
+func (o ymlOffer) cells() []string {
+	available := strings.TrimSpace(o.Available)
+	if available == "" {
+		available = "true"
+	}
+	count := strings.TrimSpace(o.Count)
+	if count == "" {
+		count = "1"
+	}
+	// в yml рубль обозначается кодом RUR
+	currency := strings.TrimSpace(o.CurrencyId)
+	if strings.EqualFold(currency, "RUR") {
+		currency = defaultCurrency
+	}
+	pictures := make([]string, 0, len(o.Pictures))
+	for _, picture := range o.Pictures {
+		if picture = strings.TrimSpace(picture); picture != "" {
+			pictures = append(pictures, picture)
+		}
+	}
+	cells := make([]string, ymlPictureColumn)
+	cells[0], cells[1], cells[2] = strings.TrimSpace(o.Id), strings.TrimSpace(o.Name), strings.TrimSpace(o.Price)
+	cells[3], cells[4], cells[5], cells[6] = count, available, currency, strings.TrimSpace(o.OldPrice)
+	cells[ymlPictureColumn-1] = strings.Join(pictures, " ")
+	return cells
+}
+
+func (y *ymlRows) Close() error {
+	return y.file.Close()
+}